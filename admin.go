@@ -0,0 +1,330 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdminHandler returns an http.Handler which allows the classes logged to be
+// inspected and changed at runtime. A GET request returns a JSON object
+// describing the current configuration:
+//
+//	{
+//	  "outputs": [{"uri": "stdout://", "class": "info+"}],
+//	  "loggers": [{"uri": "file:///var/log/db.log", "class": "debug+", "names": ["db"]}],
+//	  "cached": ["stdout://", "file:///var/log/app.log", "file:///var/log/db.log"],
+//	  "names": {"db": "debug+"}
+//	}
+//
+// where outputs lists the default outputs along with their classes, loggers
+// lists the outputs added to individual Loggers with AddOutput or UpdateOutput
+// along with their classes and the names of the Loggers using them, cached
+// lists the URI of every output that has been created, and names lists the
+// classes configured with SetNameClasses. Passwords and the values of header.*
+// parameters are masked in the URIs.
+//
+// A PUT request takes an object of the same form, in which the classes of the
+// default outputs and Logger outputs with the given URIs and of the given names
+// are changed. The URI of an output may be given as returned by a GET request.
+// If names are given for a Logger output then only the outputs used by Loggers
+// with one of those names are changed. A name with an empty class has its
+// configuration removed. Changing the classes of an output applies to every
+// Logger using it, including the Loggers cloned from the one it was added to.
+// If a "ttl" duration such as "10m" is included then the changes are reverted
+// once it has elapsed, unless they were changed again in the meantime. The
+// response is the configuration after the changes were applied.
+//
+// The handler performs no authentication, so it should only be served on an
+// interface which is not publicly accessible.
+func AdminHandler() http.Handler {
+	return adminHandler{}
+}
+
+// The JSON representation of the configuration used by AdminHandler.
+type adminConfig struct {
+	Outputs []adminOutput     `json:"outputs"`
+	Loggers []adminOutput     `json:"loggers,omitempty"`
+	Cached  []string          `json:"cached,omitempty"`
+	Names   map[string]string `json:"names"`
+	TTL     string            `json:"ttl,omitempty"`
+}
+
+// The JSON representation of a default output, or of an output added to
+// individual Loggers along with the names of the Loggers using it.
+type adminOutput struct {
+	URI   string   `json:"uri"`
+	Class string   `json:"class"`
+	Names []string `json:"names,omitempty"`
+}
+
+var (
+	// The change waiting to be reverted for each output or name,
+	// keyed by the *loggerOutputWrapper or name. Entries are removed when they
+	// are reverted or replaced by a change without a ttl, which ensures that a
+	// revert does not undo a later change. Protected by adminMutex.
+	adminPending = make(map[interface{}]uint64)
+
+	// Incremented for each change made by AdminHandler so that every change
+	// can be identified. Protected by adminMutex.
+	adminChangeCount uint64
+
+	adminMutex sync.Mutex
+)
+
+// adminHandler implements the handler returned by AdminHandler.
+type adminHandler struct{}
+
+// Serves GET and PUT requests.
+func (h adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT":
+		var config adminConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := applyAdminConfig(&config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, _ := json.MarshalIndent(currentAdminConfig(), "", "  ")
+	w.Write(append(data, '\n'))
+}
+
+// Returns the current configuration.
+func currentAdminConfig() *adminConfig {
+	config := &adminConfig{Names: make(map[string]string)}
+
+	defaultOutputMutex.RLock()
+	for _, o := range defaultOutputs {
+		config.Outputs = append(config.Outputs, adminOutput{
+			URI:   redactedURI(o.OutputWrapper.uri),
+			Class: o.Class().String(),
+		})
+	}
+	defaultOutputMutex.RUnlock()
+
+	loggerOutputMutex.Lock()
+	for lo, names := range loggerOutputs {
+		o := adminOutput{URI: redactedURI(lo.OutputWrapper.uri), Class: lo.Class().String()}
+		for name := range names {
+			o.Names = append(o.Names, name)
+		}
+		sort.Strings(o.Names)
+		config.Loggers = append(config.Loggers, o)
+	}
+	loggerOutputMutex.Unlock()
+	sort.Slice(config.Loggers, func(i, j int) bool {
+		a, b := config.Loggers[i], config.Loggers[j]
+		if a.URI != b.URI {
+			return a.URI < b.URI
+		}
+		return strings.Join(a.Names, ",") < strings.Join(b.Names, ",")
+	})
+
+	for _, ow := range cachedOutputs() {
+		config.Cached = append(config.Cached, redactedURI(ow.uri))
+	}
+	sort.Strings(config.Cached)
+
+	for name, class := range NameClasses() {
+		config.Names[name] = class.String()
+	}
+	return config
+}
+
+// Returns the URI with its password and the values of any header.* parameters
+// masked, as these may contain credentials.
+func redactedURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	values := u.Query()
+	masked := false
+	for k := range values {
+		if strings.HasPrefix(k, "header.") {
+			values[k] = []string{"xxxxx"}
+			masked = true
+		}
+	}
+	if masked {
+		u.RawQuery = values.Encode()
+	} else if _, ok := u.User.Password(); !ok {
+		// Nothing needs to be masked, so the URI is returned as given rather
+		// than as reformatted by url.URL.
+		return uri
+	}
+	return u.Redacted()
+}
+
+// Applies the changes in the given configuration, scheduling them to be
+// reverted if a TTL is given. Nothing is changed if the configuration is
+// invalid.
+func applyAdminConfig(config *adminConfig) error {
+	var ttl time.Duration
+	if config.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(config.TTL); err != nil || ttl <= 0 {
+			return fmt.Errorf("Invalid ttl: %s", config.TTL)
+		}
+	}
+	outputs := make(map[string]LogClass, len(config.Outputs))
+	for _, o := range config.Outputs {
+		class, err := ParseLogClass(o.Class)
+		if err != nil {
+			return err
+		}
+		outputs[o.URI] = class
+	}
+	for _, o := range config.Loggers {
+		if _, err := ParseLogClass(o.Class); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]LogClass, len(config.Names))
+	for name, c := range config.Names {
+		class := NONE
+		if c != "" {
+			var err error
+			if class, err = ParseLogClass(c); err != nil {
+				return err
+			}
+		}
+		names[name] = class
+	}
+
+	adminMutex.Lock()
+	defer adminMutex.Unlock()
+	defaultOutputMutex.Lock()
+	defer defaultOutputMutex.Unlock()
+	nameMutex.Lock()
+	defer nameMutex.Unlock()
+	loggerOutputMutex.Lock()
+	defer loggerOutputMutex.Unlock()
+	defer atomic.AddUint32(&classGeneration, 1)
+
+	// Outputs may be given by their URI or by the redacted form of it.
+	matched := make(map[string]bool, len(outputs))
+	selected := make(map[*loggerOutputWrapper]LogClass, len(defaultOutputs))
+	for _, o := range defaultOutputs {
+		for _, uri := range []string{o.OutputWrapper.uri, redactedURI(o.OutputWrapper.uri)} {
+			if class, ok := outputs[uri]; ok {
+				matched[uri] = true
+				selected[o] = class
+				break
+			}
+		}
+	}
+	for uri := range outputs {
+		if !matched[uri] {
+			return fmt.Errorf("Unknown default output: %s", uri)
+		}
+	}
+	for _, o := range config.Loggers {
+		class, _ := ParseLogClass(o.Class)
+		found := false
+		for lo, names := range loggerOutputs {
+			if o.URI != lo.OutputWrapper.uri && o.URI != redactedURI(lo.OutputWrapper.uri) {
+				continue
+			}
+			used := len(o.Names) == 0
+			for _, name := range o.Names {
+				if names[name] > 0 {
+					used = true
+					break
+				}
+			}
+			if used {
+				found = true
+				selected[lo] = class
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown Logger output: %s", o.URI)
+		}
+	}
+
+	// Reverts only apply if nothing else has changed the class since, whether
+	// through AdminHandler or otherwise, such as by Configure.
+	adminChangeCount++
+	change := adminChangeCount
+	pending := func(key interface{}) {
+		if ttl > 0 {
+			adminPending[key] = change
+		} else {
+			delete(adminPending, key)
+		}
+	}
+	var reverts []func()
+	for o, class := range selected {
+		o, class, previous := o, class, o.Class()
+		o.setClass(class)
+		pending(o)
+		reverts = append(reverts, func() {
+			if adminPending[o] != change {
+				return
+			}
+			delete(adminPending, o)
+			if o.Class() == class {
+				o.setClass(previous)
+			}
+		})
+	}
+	for name, class := range names {
+		name, class, removed := name, class, config.Names[name] == ""
+		previous, existed := nameClasses[name]
+		if removed {
+			delete(nameClasses, name)
+		} else {
+			nameClasses[name] = class
+		}
+		pending(name)
+		reverts = append(reverts, func() {
+			if adminPending[name] != change {
+				return
+			}
+			delete(adminPending, name)
+			if current, ok := nameClasses[name]; ok == removed || (ok && current != class) {
+				return
+			} else if existed {
+				nameClasses[name] = previous
+			} else {
+				delete(nameClasses, name)
+			}
+		})
+	}
+
+	if ttl > 0 && len(reverts) > 0 {
+		time.AfterFunc(ttl, func() {
+			adminMutex.Lock()
+			defer adminMutex.Unlock()
+			defaultOutputMutex.Lock()
+			defer defaultOutputMutex.Unlock()
+			nameMutex.Lock()
+			defer nameMutex.Unlock()
+			for _, revert := range reverts {
+				revert()
+			}
+			atomic.AddUint32(&classGeneration, 1)
+		})
+	}
+	return nil
+}
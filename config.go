@@ -0,0 +1,292 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config describes the default outputs, name classes and queue settings used
+// by Configure. Sections which are nil are left unchanged, so an empty Outputs
+// slice removes all default outputs while a nil one keeps them.
+type Config struct {
+	// The default outputs for newly created Loggers. These replace the
+	// existing default outputs as described by Configure.
+	Outputs []OutputConfig `json:"outputs,omitempty"`
+
+	// The classes for each logger name, in the form accepted by ParseLogClass.
+	// These replace all existing name classes (see SetNameClasses).
+	Names map[string]string `json:"names,omitempty"`
+
+	// The queue settings for outputs created from now on.
+	Queue *QueueConfig `json:"queue,omitempty"`
+}
+
+// OutputConfig describes a single default output.
+type OutputConfig struct {
+	// The URI of the output, as passed to AddDefaultOutput.
+	URI string `json:"uri"`
+
+	// The classes logged to the output, in the form accepted by ParseLogClass.
+	Class string `json:"class"`
+}
+
+// QueueConfig describes the settings applied to the queues of new outputs.
+// Empty members are left unchanged.
+type QueueConfig struct {
+	// Sets DefaultQueueSize.
+	Size int `json:"size,omitempty"`
+
+	// Sets DefaultOverflowPolicy, see ParseOverflowPolicy.
+	Overflow string `json:"overflow,omitempty"`
+
+	// Sets DefaultOverflowTimeout, as parsed by time.ParseDuration.
+	OverflowTimeout string `json:"overflowtimeout,omitempty"`
+}
+
+// Serializes calls to Configure.
+var configureMutex sync.Mutex
+
+// ConfigureFromJSON reads a Config encoded as JSON from the reader and applies
+// it with Configure. For example:
+//
+//	{
+//	  "outputs": [
+//	    {"uri": "stdout://", "class": "info+"},
+//	    {"uri": "file:///var/log/app.log?format=json", "class": "debug|error"}
+//	  ],
+//	  "names": {"db": "debug+", "db.pool": "warn+"},
+//	  "queue": {"size": 5000, "overflow": "drop"}
+//	}
+func ConfigureFromJSON(r io.Reader) error {
+	var config Config
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return fmt.Errorf("Invalid configuration: %s", err)
+	}
+	return Configure(&config)
+}
+
+// ConfigureFromEnv builds a Config from environment variables whose names
+// start with the given prefix and applies it with Configure. With a prefix of
+// "LOGRAY_" the following variables are used:
+//
+//	LOGRAY_OUTPUT_<n>          The URI of a default output. Outputs are
+//	                           added in order of n, which must be a number.
+//	LOGRAY_OUTPUT_<n>_CLASS    The classes logged to that output.
+//	LOGRAY_NAMES               Name classes in the form accepted by
+//	                           ConfigureNameClasses.
+//	LOGRAY_QUEUE_SIZE          See QueueConfig.
+//	LOGRAY_OVERFLOW            See QueueConfig.
+//	LOGRAY_OVERFLOW_TIMEOUT    See QueueConfig.
+//
+// Sections with no variables set are left unchanged.
+func ConfigureFromEnv(prefix string) error {
+	config, err := envConfig(prefix, os.Environ())
+	if err != nil {
+		return err
+	}
+	return Configure(config)
+}
+
+// Builds a Config from the given environment, in the form returned by
+// os.Environ.
+func envConfig(prefix string, environ []string) (*Config, error) {
+	config := &Config{}
+	env := make(map[string]string, len(environ))
+	var outputs []int
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], prefix) {
+			continue
+		}
+		key := parts[0][len(prefix):]
+		env[key] = parts[1]
+		if strings.HasPrefix(key, "OUTPUT_") && !strings.HasSuffix(key, "_CLASS") {
+			n, err := strconv.Atoi(key[len("OUTPUT_"):])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid output variable: %s", parts[0])
+			}
+			outputs = append(outputs, n)
+		}
+	}
+
+	sort.Ints(outputs)
+	for _, n := range outputs {
+		key := "OUTPUT_" + strconv.Itoa(n)
+		class, ok := env[key+"_CLASS"]
+		if !ok {
+			return nil, fmt.Errorf("Missing %s%s_CLASS", prefix, key)
+		}
+		config.Outputs = append(config.Outputs, OutputConfig{URI: env[key], Class: class})
+	}
+
+	if spec, ok := env["NAMES"]; ok {
+		classes, err := parseNameClasses(spec)
+		if err != nil {
+			return nil, err
+		}
+		config.Names = make(map[string]string, len(classes))
+		for name, class := range classes {
+			config.Names[name] = class.String()
+		}
+	}
+
+	size, hasSize := env["QUEUE_SIZE"]
+	overflow, hasOverflow := env["OVERFLOW"]
+	timeout, hasTimeout := env["OVERFLOW_TIMEOUT"]
+	if hasSize || hasOverflow || hasTimeout {
+		config.Queue = &QueueConfig{Overflow: overflow, OverflowTimeout: timeout}
+		if hasSize {
+			var err error
+			if config.Queue.Size, err = strconv.Atoi(size); err != nil {
+				return nil, fmt.Errorf("Invalid queue size: %s", size)
+			}
+		}
+	}
+	return config, nil
+}
+
+// Configure validates the given configuration and then applies it. If any part
+// of the configuration is invalid, including an output that can not be
+// created, then an error is returned and nothing is changed.
+//
+// The configured outputs are compared against the current default outputs by
+// URI. Outputs that remain have their classes updated in place, which applies
+// to every Logger created with them. Outputs that are no longer configured stop
+// receiving lines from those Loggers, and are flushed and closed unless a Logger
+// still uses the same URI through AddOutput. New outputs are only used by
+// Loggers created after this call. Changes to name classes apply immediately to
+// all Loggers.
+func Configure(config *Config) error {
+	configureMutex.Lock()
+	defer configureMutex.Unlock()
+
+	// Validate everything which does not require creating outputs first.
+	classes := make([]LogClass, len(config.Outputs))
+	for i, o := range config.Outputs {
+		var err error
+		if classes[i], err = ParseLogClass(o.Class); err != nil {
+			return fmt.Errorf("Invalid class for %s: %s", o.URI, err)
+		}
+	}
+	var names map[string]LogClass
+	if config.Names != nil {
+		names = make(map[string]LogClass, len(config.Names))
+		for name, c := range config.Names {
+			class, err := ParseLogClass(c)
+			if err != nil {
+				return fmt.Errorf("Invalid class for name %s: %s", name, err)
+			}
+			names[name] = class
+		}
+	}
+	size, policy, timeout := DefaultQueueSize, DefaultOverflowPolicy, DefaultOverflowTimeout
+	if q := config.Queue; q != nil {
+		if q.Size < 0 {
+			return fmt.Errorf("Invalid queue size: %d", q.Size)
+		} else if q.Size > 0 {
+			size = q.Size
+		}
+		if q.Overflow != "" {
+			var err error
+			if policy, err = ParseOverflowPolicy(q.Overflow); err != nil {
+				return err
+			}
+		}
+		if q.OverflowTimeout != "" {
+			var err error
+			timeout, err = time.ParseDuration(q.OverflowTimeout)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("Invalid overflow timeout: %s", q.OverflowTimeout)
+			}
+		}
+	}
+
+	// Create the new outputs with the new queue settings, undoing everything
+	// if any of them fail.
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	defaultOutputMutex.Lock()
+	defer defaultOutputMutex.Unlock()
+	oldSize, oldPolicy, oldTimeout := DefaultQueueSize, DefaultOverflowPolicy, DefaultOverflowTimeout
+	DefaultQueueSize, DefaultOverflowPolicy, DefaultOverflowTimeout = size, policy, timeout
+
+	// Default outputs with the same URI as a configured output are kept, while
+	// the rest of the configured outputs are created.
+	var outputs []*loggerOutputWrapper
+	var created []*outputWrapper
+	kept := make(map[*loggerOutputWrapper]bool, len(defaultOutputs))
+	for _, o := range config.Outputs {
+		var lo *loggerOutputWrapper
+		for _, existing := range defaultOutputs {
+			if existing.OutputWrapper.uri == o.URI && !kept[existing] {
+				lo = existing
+				kept[lo] = true
+				break
+			}
+		}
+		if lo == nil {
+			ow, err := lockedNewOutput(o.URI)
+			if err != nil {
+				DefaultQueueSize, DefaultOverflowPolicy, DefaultOverflowTimeout = oldSize, oldPolicy, oldTimeout
+				for _, ow := range created {
+					lockedReleaseOutput(ow)
+				}
+				return fmt.Errorf("Invalid output %s: %s", o.URI, err)
+			}
+			created = append(created, ow)
+			lo = &loggerOutputWrapper{OutputWrapper: ow}
+		}
+		outputs = append(outputs, lo)
+	}
+
+	if config.Outputs != nil {
+		// Classes are changed in place so that they apply to existing Loggers
+		// which were created with the default outputs. Removed outputs stop
+		// receiving lines from those Loggers, and are closed unless they are
+		// still used elsewhere, such as by one of the new default outputs or
+		// by a Logger which added the same URI with AddOutput.
+		for i, lo := range outputs {
+			lo.setClass(classes[i])
+		}
+		for _, lo := range defaultOutputs {
+			if !kept[lo] {
+				lo.setClass(NONE)
+				lockedReleaseOutput(lo.OutputWrapper)
+			}
+		}
+		defaultOutputs = outputs
+	}
+	if names != nil {
+		nameMutex.Lock()
+		nameClasses = names
+		nameMutex.Unlock()
+	}
+	atomic.AddUint32(&classGeneration, 1)
+	return nil
+}
+
+// Releases a reference to an output added by lockedNewOutput. Once no
+// references remain the output is removed from the cache and closed once its
+// queue has drained. This must be called with updateMutex held.
+func lockedReleaseOutput(ow *outputWrapper) {
+	ow.refs--
+	if ow.refs > 0 {
+		return
+	}
+	if outputMap[ow.uri] == ow {
+		delete(outputMap, ow.uri)
+	}
+	closeOutput(ow)
+}
@@ -0,0 +1,246 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the default outputs as a map of URI to class.
+func defaultOutputClasses() map[string]LogClass {
+	defaultOutputMutex.RLock()
+	defer defaultOutputMutex.RUnlock()
+	classes := make(map[string]LogClass, len(defaultOutputs))
+	for _, o := range defaultOutputs {
+		classes[o.OutputWrapper.uri] = o.Class()
+	}
+	return classes
+}
+
+func TestConfigureFromJSON(t *testing.T) {
+	ResetCachedOutputs()
+	ResetDefaultOutput()
+	defer ResetDefaultOutput()
+	defer ResetNameClasses("db")
+	defer func(size int, policy OverflowPolicy) {
+		DefaultQueueSize, DefaultOverflowPolicy = size, policy
+	}(DefaultQueueSize, DefaultOverflowPolicy)
+
+	err := ConfigureFromJSON(strings.NewReader(`{
+		"outputs": [
+			{"uri": "discard://", "class": "info+"},
+			{"uri": "discard://?overflow=block", "class": "debug|error"}
+		],
+		"names": {"db": "warn+"},
+		"queue": {"size": 10, "overflow": "drop"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]LogClass{
+		"discard://":                INFOPLUS,
+		"discard://?overflow=block": DEBUG | ERROR,
+	}
+	if classes := defaultOutputClasses(); !reflect.DeepEqual(classes, expected) {
+		t.Fatalf("Expected default outputs %v, got %v", expected, classes)
+	}
+	if classes := NameClasses(); len(classes) != 1 || classes["db"] != WARNPLUS {
+		t.Fatalf("Unexpected name classes: %v", classes)
+	}
+	if DefaultQueueSize != 10 || DefaultOverflowPolicy != OverflowDropNewest {
+		t.Fatalf("Unexpected queue settings: %d %s", DefaultQueueSize, DefaultOverflowPolicy)
+	}
+}
+
+func TestConfigureIsAtomic(t *testing.T) {
+	ResetCachedOutputs()
+	ResetDefaultOutput()
+	defer ResetDefaultOutput()
+	if err := AddDefaultOutput("discard://", ALL); err != nil {
+		t.Fatal(err)
+	}
+	size := DefaultQueueSize
+
+	for _, config := range []string{
+		`{"outputs": [{"uri": "discard://?queue=5", "class": "info"}, {"uri": "bogus://", "class": "info"}]}`,
+		`{"outputs": [{"uri": "discard://?queue=5", "class": "sometimes"}]}`,
+		`{"names": {"db": "loud"}, "queue": {"size": 3}}`,
+		`{"queue": {"size": 3, "overflow": "explode"}}`,
+		`{"unknown": true}`,
+	} {
+		if err := ConfigureFromJSON(strings.NewReader(config)); err == nil {
+			t.Fatalf("Expected an error for %s", config)
+		}
+	}
+
+	if classes := defaultOutputClasses(); len(classes) != 1 || classes["discard://"] != ALL {
+		t.Fatalf("The default outputs were changed: %v", classes)
+	}
+	if DefaultQueueSize != size {
+		t.Fatalf("The queue size was changed to %d", DefaultQueueSize)
+	}
+	for _, ow := range cachedOutputs() {
+		if ow.uri != "discard://" {
+			t.Fatalf("An output from a failed configuration was cached: %s", ow.uri)
+		}
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	config, err := envConfig("LOGRAY_", []string{
+		"LOGRAY_OUTPUT_10=discard://?second",
+		"LOGRAY_OUTPUT_10_CLASS=error+",
+		"LOGRAY_OUTPUT_2=discard://?first",
+		"LOGRAY_OUTPUT_2_CLASS=debug|warn",
+		"LOGRAY_NAMES=db=debug+, db.pool=warn",
+		"LOGRAY_OVERFLOW=dropoldest",
+		"OTHER_OUTPUT_1=stdout://",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Config{
+		Outputs: []OutputConfig{
+			{URI: "discard://?first", Class: "debug|warn"},
+			{URI: "discard://?second", Class: "error+"},
+		},
+		Names: map[string]string{"db": "debug+", "db.pool": "warn"},
+		Queue: &QueueConfig{Overflow: "dropoldest"},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, config)
+	}
+
+	for _, environ := range [][]string{
+		{"LOGRAY_OUTPUT_1=stdout://"},
+		{"LOGRAY_OUTPUT_X=stdout://", "LOGRAY_OUTPUT_X_CLASS=info"},
+		{"LOGRAY_NAMES=db"},
+		{"LOGRAY_QUEUE_SIZE=big"},
+	} {
+		if _, err := envConfig("LOGRAY_", environ); err == nil {
+			t.Fatalf("Expected an error for %v", environ)
+		}
+	}
+}
+
+func TestConfigureKeepsOutputsUsedByLoggers(t *testing.T) {
+	o := &closingOutput{}
+	ResetCachedOutputs()
+	ResetDefaultOutput()
+	defer ResetDefaultOutput()
+	AddNewOutputFunc("testconfigureshared", func(u *url.URL) (Output, error) {
+		return o, nil
+	})
+	if err := AddDefaultOutput("testconfigureshared://", ALL); err != nil {
+		t.Fatal(err)
+	}
+	logger := New()
+	logger.ResetOutput()
+	if err := logger.AddOutput("testconfigureshared://", ALL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing the default output must not close the output the Logger added.
+	if err := Configure(&Config{Outputs: []OutputConfig{}}); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("after")
+	logger.Flush()
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed || len(o.lines) != 1 {
+		t.Fatalf("Expected the output to remain open, got %#v", o)
+	}
+}
+
+func TestResetCachedOutputsKeepsDefaults(t *testing.T) {
+	o := &closingOutput{}
+	ResetCachedOutputs()
+	ResetDefaultOutput()
+	defer ResetDefaultOutput()
+	AddNewOutputFunc("testresetkeep", func(u *url.URL) (Output, error) {
+		return o, nil
+	})
+	if err := AddDefaultOutput("testresetkeep://", INFOPLUS); err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing and new Loggers keep writing to the default output.
+	logger := New()
+	ResetCachedOutputs()
+	logger.Info("existing")
+	New().Info("new")
+	logger.Flush()
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		t.Fatal("The output was closed.")
+	} else if len(o.lines) != 2 {
+		t.Fatalf("Unexpected lines written: %v", o.lines)
+	}
+}
+
+func TestCloseCachedOutputs(t *testing.T) {
+	o := &closingOutput{}
+	ResetCachedOutputs()
+	AddNewOutputFunc("testresetdefault", func(u *url.URL) (Output, error) {
+		return o, nil
+	})
+	if err := AddDefaultOutput("testresetdefault://", INFOPLUS); err != nil {
+		t.Fatal(err)
+	}
+
+	// New Loggers must not be given the closed output.
+	CloseCachedOutputs()
+	if classes := defaultOutputClasses(); len(classes) != 0 {
+		t.Fatalf("Expected no default outputs, got %v", classes)
+	}
+	if logger := New(); logger.Enabled(INFO) {
+		t.Fatalf("Expected a new Logger to have no outputs.")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		o.mutex.Lock()
+		closed := o.closed
+		o.mutex.Unlock()
+		if closed {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("The output was not closed.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConfigureConcurrentLogging(t *testing.T) {
+	ResetCachedOutputs()
+	defer ResetDefaultOutput()
+	if err := AddDefaultOutput("discard://", INFOPLUS); err != nil {
+		t.Fatal(err)
+	}
+	logger := New()
+
+	// Run with -race in order to check that classes are changed safely.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			logger.Info("line")
+		}
+	}()
+	for _, class := range []string{"debug+", "warn+"} {
+		err := Configure(&Config{Outputs: []OutputConfig{{URI: "discard://", Class: class}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Configure(&Config{Outputs: []OutputConfig{}}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
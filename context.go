@@ -0,0 +1,177 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"context"
+	"fmt"
+)
+
+// The type of the keys used to store values in a context.Context, which
+// prevents collisions with keys defined by other packages.
+type contextKey int
+
+const (
+	// The key for the *Logger stored by NewContext.
+	loggerContextKey contextKey = iota
+
+	// The key for the *fieldNode chain stored by ContextFields.
+	fieldsContextKey
+)
+
+var (
+	// If not empty, lines logged via the Ctx methods with a context that has a
+	// deadline will include the deadline as a field with this name.
+	ContextDeadlineField = ""
+
+	// If not empty, lines logged via the Ctx methods with a context that has
+	// been cancelled will include the cause of the cancellation as a field with
+	// this name (see context.Cause).
+	ContextErrorField = ""
+)
+
+// NewContext returns a copy of the context which carries the given Logger. The
+// Logger can be retrieved further down the call chain with FromContext.
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
+// FromContext returns the Logger stored in the context by NewContext. If the
+// context does not carry a Logger then a new one with the default configuration
+// is returned.
+func FromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerContextKey).(*Logger); ok {
+		return logger
+	}
+	return New()
+}
+
+// ContextFields returns a copy of the context with the given field added to
+// it. Fields stored in a context are added to lines logged via the Ctx methods
+// of any Logger, taking precedence over the Logger's own fields.
+func ContextFields(ctx context.Context, key string, value interface{}) context.Context {
+	fields, _ := ctx.Value(fieldsContextKey).(*fieldNode)
+	return context.WithValue(ctx, fieldsContextKey, fields.with(key, value, false))
+}
+
+// Injects a log in the trace class for this category, including the fields
+// stored in the context. This will format the given arguments using fmt.Sprint.
+func (logger *Logger) TraceCtx(ctx context.Context, args ...interface{}) {
+	if !logger.Enabled(TRACE) {
+		return
+	}
+	logger.logCtx(ctx, TRACE, fmt.Sprint(args...))
+}
+
+// Injects a log in the trace class for this category, including the fields
+// stored in the context. This formats the log line using the format string
+// provided (See fmt.Sprintf).
+func (logger *Logger) TracefCtx(ctx context.Context, format string, args ...interface{}) {
+	if !logger.Enabled(TRACE) {
+		return
+	}
+	logger.logCtx(ctx, TRACE, fmt.Sprintf(format, args...))
+}
+
+// Injects a log in the debug class for this category, including the fields
+// stored in the context. This will format the given arguments using fmt.Sprint.
+func (logger *Logger) DebugCtx(ctx context.Context, args ...interface{}) {
+	if !logger.Enabled(DEBUG) {
+		return
+	}
+	logger.logCtx(ctx, DEBUG, fmt.Sprint(args...))
+}
+
+// Injects a log in the debug class for this category, including the fields
+// stored in the context. This formats the log line using the format string
+// provided (See fmt.Sprintf).
+func (logger *Logger) DebugfCtx(ctx context.Context, format string, args ...interface{}) {
+	if !logger.Enabled(DEBUG) {
+		return
+	}
+	logger.logCtx(ctx, DEBUG, fmt.Sprintf(format, args...))
+}
+
+// Injects a log in the info class for this category, including the fields
+// stored in the context. This will format the given arguments using fmt.Sprint.
+func (logger *Logger) InfoCtx(ctx context.Context, args ...interface{}) {
+	if !logger.Enabled(INFO) {
+		return
+	}
+	logger.logCtx(ctx, INFO, fmt.Sprint(args...))
+}
+
+// Injects a log in the info class for this category, including the fields
+// stored in the context. This formats the log line using the format string
+// provided (See fmt.Sprintf).
+func (logger *Logger) InfofCtx(ctx context.Context, format string, args ...interface{}) {
+	if !logger.Enabled(INFO) {
+		return
+	}
+	logger.logCtx(ctx, INFO, fmt.Sprintf(format, args...))
+}
+
+// Injects a log in the warn class for this category, including the fields
+// stored in the context. This will format the given arguments using fmt.Sprint.
+func (logger *Logger) WarnCtx(ctx context.Context, args ...interface{}) {
+	if !logger.Enabled(WARN) {
+		return
+	}
+	logger.logCtx(ctx, WARN, fmt.Sprint(args...))
+}
+
+// Injects a log in the warn class for this category, including the fields
+// stored in the context. This formats the log line using the format string
+// provided (See fmt.Sprintf).
+func (logger *Logger) WarnfCtx(ctx context.Context, format string, args ...interface{}) {
+	if !logger.Enabled(WARN) {
+		return
+	}
+	logger.logCtx(ctx, WARN, fmt.Sprintf(format, args...))
+}
+
+// Injects a log in the error class for this category, including the fields
+// stored in the context. This will format the given arguments using fmt.Sprint.
+func (logger *Logger) ErrorCtx(ctx context.Context, args ...interface{}) {
+	if !logger.Enabled(ERROR) {
+		return
+	}
+	logger.logCtx(ctx, ERROR, fmt.Sprint(args...))
+}
+
+// Injects a log in the error class for this category, including the fields
+// stored in the context. This formats the log line using the format string
+// provided (See fmt.Sprintf).
+func (logger *Logger) ErrorfCtx(ctx context.Context, format string, args ...interface{}) {
+	if !logger.Enabled(ERROR) {
+		return
+	}
+	logger.logCtx(ctx, ERROR, fmt.Sprintf(format, args...))
+}
+
+// logCtx is the same as log, but adds the fields stored in the context along
+// with its deadline and cancellation cause if those are enabled.
+func (logger *Logger) logCtx(ctx context.Context, logClass LogClass, message string) {
+	if isShutdown() {
+		return
+	}
+	ld := logger.newLineData(logClass, message)
+
+	if fields, ok := ctx.Value(fieldsContextKey).(*fieldNode); ok {
+		for k, v := range fields.collect() {
+			ld.Fields[k] = v
+		}
+	}
+	if ContextDeadlineField != "" {
+		if deadline, ok := ctx.Deadline(); ok {
+			ld.Fields[ContextDeadlineField] = deadline
+		}
+	}
+	if ContextErrorField != "" {
+		if err := context.Cause(ctx); err != nil {
+			ld.Fields[ContextErrorField] = err.Error()
+		}
+	}
+
+	logger.write(ld)
+}
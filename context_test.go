@@ -0,0 +1,77 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestContextLogger(t *testing.T) {
+	logger := New()
+	ctx := NewContext(context.Background(), logger)
+	if FromContext(ctx) != logger {
+		t.Fatal("FromContext did not return the stored Logger.")
+	}
+	if FromContext(context.Background()) == nil {
+		t.Fatal("FromContext did not return a default Logger.")
+	}
+}
+
+func TestContextFields(t *testing.T) {
+	logger, o := newTestOutputLogger(t, "testcontextfields", ALL)
+	logger.SetField("service", "api")
+	logger.SetField("request", "logger")
+
+	ctx := ContextFields(context.Background(), "request", 42)
+	ctx = ContextFields(ctx, "user", "bob")
+	logger.InfofCtx(ctx, "handled %s", "it")
+	logger.Info("plain")
+	logger.Flush()
+
+	if len(o.lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(o.lines))
+	}
+	ld := o.lines[0]
+	if ld.Message != "handled it" || ld.SourceFile != "context_test.go" {
+		t.Fatalf("Unexpected line: %#v", ld)
+	}
+	if ld.Fields["service"] != "api" || ld.Fields["request"] != 42 || ld.Fields["user"] != "bob" {
+		t.Fatalf("Unexpected fields: %v", ld.Fields)
+	}
+	if o.lines[1].Fields["request"] != "logger" || o.lines[1].Fields["user"] != nil {
+		t.Fatalf("Context fields leaked into a plain line: %v", o.lines[1].Fields)
+	}
+}
+
+func TestContextDeadlineAndCause(t *testing.T) {
+	logger, o := newTestOutputLogger(t, "testcontextdeadline", ALL)
+	defer func(deadline, cause string) {
+		ContextDeadlineField, ContextErrorField = deadline, cause
+	}(ContextDeadlineField, ContextErrorField)
+	ContextDeadlineField, ContextErrorField = "deadline", "cause"
+
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	logger.WarnCtx(ctx, "running")
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	cancelCause(errors.New("client went away"))
+	logger.WarnCtx(ctx, "cancelled")
+	logger.Flush()
+
+	if len(o.lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(o.lines))
+	}
+	if d, _ := o.lines[0].Fields["deadline"].(time.Time); !d.Equal(deadline) {
+		t.Fatalf("Unexpected deadline: %v", o.lines[0].Fields)
+	}
+	if _, ok := o.lines[0].Fields["cause"]; ok {
+		t.Fatalf("Unexpected cause on a running context: %v", o.lines[0].Fields)
+	}
+	if o.lines[1].Fields["cause"] != "client went away" {
+		t.Fatalf("Unexpected cause: %v", o.lines[1].Fields)
+	}
+}
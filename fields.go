@@ -0,0 +1,145 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+// The number of field nodes that can be chained on a Logger before they are
+// compacted into a single node.
+const maxFieldDepth = 16
+
+// fieldNode is an immutable layer of fields. Each Logger points at the newest
+// node in a chain, and setting or removing a field pushes a new node rather
+// than modifying an existing one. This allows Loggers to share their parent's
+// fields without copying them and without locking the parent on each log call.
+type fieldNode struct {
+	// The next oldest node in the chain.
+	parent *fieldNode
+
+	// The number of nodes in the chain, including this one.
+	depth int
+
+	// The field set or removed by this node.
+	key     string
+	value   interface{}
+	removed bool
+
+	// If not nil this node holds a flattened set of fields instead of a single
+	// field, and has no parent. The map is never modified once created.
+	fields map[string]interface{}
+}
+
+// Returns a new chain with the given field set, or removed if remove is true.
+// Deep chains are compacted so that collecting the fields stays cheap.
+func (n *fieldNode) with(key string, value interface{}, remove bool) *fieldNode {
+	if n != nil && n.depth >= maxFieldDepth {
+		n = &fieldNode{depth: 1, fields: n.collect()}
+	}
+	node := &fieldNode{parent: n, depth: 1, key: key, value: value, removed: remove}
+	if n != nil {
+		node.depth += n.depth
+	}
+	return node
+}
+
+// Returns a new map holding the fields in the chain, where newer nodes take
+// precedence over older ones.
+func (n *fieldNode) collect() map[string]interface{} {
+	if n == nil {
+		return make(map[string]interface{})
+	}
+
+	size := n.depth
+	var removed map[string]bool
+	for node := n; node != nil; node = node.parent {
+		size += len(node.fields)
+	}
+	fields := make(map[string]interface{}, size)
+	for node := n; node != nil; node = node.parent {
+		if node.fields != nil {
+			for k, v := range node.fields {
+				if _, ok := fields[k]; !ok && !removed[k] {
+					fields[k] = v
+				}
+			}
+			continue
+		}
+		if _, ok := fields[node.key]; ok || removed[node.key] {
+			continue
+		}
+		if node.removed {
+			if removed == nil {
+				removed = make(map[string]bool)
+			}
+			removed[node.key] = true
+			continue
+		}
+		fields[node.key] = node.value
+	}
+	return fields
+}
+
+// Fields returns a copy of the fields that are associated with each line
+// logged by the Logger. Changes to the returned map do not affect the Logger;
+// use SetField, SetFields, RemoveFields or ClearFields instead. Fields replaces
+// the exported map of the same name that earlier versions of the Logger had.
+func (logger *Logger) Fields() map[string]interface{} {
+	return logger.copyFields()
+}
+
+// copyFields returns a copy of the Logger's fields which can be attached to a
+// LineData.
+func (logger *Logger) copyFields() map[string]interface{} {
+	logger.fieldMutex.RLock()
+	fields := logger.fields
+	logger.fieldMutex.RUnlock()
+	return fields.collect()
+}
+
+// WithField returns a Clone of the Logger with the given field set. The
+// original Logger is not modified.
+func (logger *Logger) WithField(key string, value interface{}) *Logger {
+	clone := logger.Clone()
+	clone.SetField(key, value)
+	return clone
+}
+
+// WithFields returns a Clone of the Logger with all of the values in the
+// provided fields map set. The original Logger is not modified.
+func (logger *Logger) WithFields(fields map[string]interface{}) *Logger {
+	clone := logger.Clone()
+	clone.SetFields(fields)
+	return clone
+}
+
+// ClearFields resets the Field on the Logger.
+func (logger *Logger) ClearFields() {
+	logger.fieldMutex.Lock()
+	logger.fields = nil
+	logger.fieldMutex.Unlock()
+}
+
+// RemoveFields will remove any of the mentioned keys from the Logger's Fields.
+func (logger *Logger) RemoveFields(keys ...string) {
+	logger.fieldMutex.Lock()
+	for _, s := range keys {
+		logger.fields = logger.fields.with(s, nil, true)
+	}
+	logger.fieldMutex.Unlock()
+}
+
+// SetFields can be used to copy all of the values in the provided fields map to
+// the current Logger.
+func (logger *Logger) SetFields(fields map[string]interface{}) {
+	logger.fieldMutex.Lock()
+	for k, v := range fields {
+		logger.fields = logger.fields.with(k, v, false)
+	}
+	logger.fieldMutex.Unlock()
+}
+
+// SetField is used to set the specified field to the provided value on the
+// current Logger.
+func (logger *Logger) SetField(key string, value interface{}) {
+	logger.fieldMutex.Lock()
+	logger.fields = logger.fields.with(key, value, false)
+	logger.fieldMutex.Unlock()
+}
@@ -0,0 +1,81 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestLoggerWithFields(t *testing.T) {
+	parent := New()
+	parent.SetField("a", 1)
+	child := parent.WithFields(map[string]interface{}{"b": 2, "c": 3})
+	grandchild := child.WithField("a", "override")
+	grandchild.RemoveFields("c")
+	parent.SetField("d", 4)
+
+	for _, test := range []struct {
+		logger   *Logger
+		expected map[string]interface{}
+	}{
+		{parent, map[string]interface{}{"a": 1, "d": 4}},
+		{child, map[string]interface{}{"a": 1, "b": 2, "c": 3}},
+		{grandchild, map[string]interface{}{"a": "override", "b": 2}},
+	} {
+		if fields := test.logger.Fields(); !reflect.DeepEqual(fields, test.expected) {
+			t.Fatalf("Expected fields %v, got %v", test.expected, fields)
+		}
+	}
+
+	grandchild.ClearFields()
+	if fields := grandchild.Fields(); len(fields) != 0 {
+		t.Fatalf("Expected no fields, got %v", fields)
+	}
+	if fields := child.Fields(); len(fields) != 3 {
+		t.Fatalf("ClearFields modified the parent: %v", fields)
+	}
+}
+
+func TestLoggerFieldCompaction(t *testing.T) {
+	logger := New()
+	expected := make(map[string]interface{})
+	for i := 0; i < 10*maxFieldDepth; i++ {
+		key := fmt.Sprintf("key%d", i%(maxFieldDepth+3))
+		logger.SetField(key, i)
+		expected[key] = i
+		if i%7 == 0 {
+			logger.RemoveFields(key)
+			delete(expected, key)
+		}
+	}
+	if logger.fields.depth > maxFieldDepth {
+		t.Fatalf("The field chain was not compacted, depth %d", logger.fields.depth)
+	}
+	if fields := logger.Fields(); !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("Expected fields %v, got %v", expected, fields)
+	}
+}
+
+func TestLoggerConcurrentFields(t *testing.T) {
+	logger, _ := newTestOutputLogger(t, "testconcurrentfields", ALL)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				logger.SetField(fmt.Sprintf("worker%d", i), j)
+				logger.WithField("request", j).Info("line")
+				logger.RemoveFields("missing")
+			}
+		}(i)
+	}
+	wg.Wait()
+	logger.Flush()
+	if fields := logger.Fields(); len(fields) != 4 {
+		t.Fatalf("Expected 4 fields, got %v", fields)
+	}
+}
@@ -0,0 +1,464 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The default port used when a Fluentd host is given without one.
+	fluentDefaultPort = "24224"
+
+	// The default maximum number of lines sent in a single PackedForward
+	// message, and the maximum time a line waits before being sent.
+	fluentDefaultBatchLines = 100
+	fluentDefaultInterval   = time.Second
+
+	// The default number of times a message is retried, the delay before the
+	// first retry, which doubles with each attempt, and the maximum delay.
+	fluentDefaultRetries    = 3
+	fluentDefaultBackoff    = 100 * time.Millisecond
+	fluentDefaultMaxBackoff = 30 * time.Second
+
+	// The default timeout for connecting, writing and waiting for an ack.
+	fluentDefaultTimeout = 5 * time.Second
+)
+
+var (
+	// The default keys used for the records sent by fluent outputs. The time is
+	// sent as part of each entry rather than in the record, and fields are
+	// added at the top level of the record.
+	DefaultFluentKeys = FieldKeys{
+		Class:      "class",
+		Message:    "message",
+		Package:    "calling_package",
+		Function:   "calling_function",
+		SourceFile: "source_file",
+		SourceLine: "source_line",
+		Name:       "name",
+	}
+)
+
+// An implementation of Output which sends log lines to Fluentd or Fluent Bit
+// using the Forward protocol. Lines are batched into PackedForward messages
+// which are sent when they are full, when the oldest line has waited for the
+// interval, or when the output is flushed. As the interval is handled by a
+// timer the batch is protected by a mutex.
+type fluentOutput struct {
+	// The network and address passed to net.Dial, and the TLS configuration
+	// if the connection uses TLS.
+	network   string
+	address   string
+	tlsConfig *tls.Config
+
+	// The tag of each message.
+	tag string
+
+	// The keys used when building each record.
+	keys FieldKeys
+
+	// If true each message includes a chunk ID, and is resent until the
+	// server acknowledges it.
+	ack bool
+
+	// The limits which cause the current batch to be sent.
+	batchLines int
+	interval   time.Duration
+
+	// The number of retries after a failed attempt, and the initial and
+	// maximum delays between attempts.
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	// The timeout for connecting, writing and waiting for an ack.
+	timeout time.Duration
+
+	// Protects the fields below, and is held while a batch is being sent so
+	// that batches are sent in order.
+	mutex sync.Mutex
+
+	// The encoded [time, record] entries of the current batch, and the number
+	// of entries.
+	entries bytes.Buffer
+	lines   int
+
+	// Sends the current batch once the interval has elapsed, or nil if the
+	// batch is empty.
+	timer *time.Timer
+
+	// The current connection and a reader for acks, or nil if disconnected.
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// The current delay between attempts, which is kept between batches, and
+	// the earliest time of the next connection attempt.
+	delay       time.Duration
+	nextAttempt time.Time
+}
+
+// Parses a URL that starts with fluent://
+//
+// The following forms are supported:
+//
+//	fluent://host:port - Connects to the host over TCP, using port 24224 if
+//	    none is given.
+//	fluent:///path - Connects to a unix stream socket.
+//
+// Each line is sent as a record containing the class, message, source and
+// name of the line along with all of its fields. The query may contain the
+// following parameters:
+//
+//	tag - The tag of each message. Defaults to the name of the running binary.
+//	ack - If true each message includes a chunk ID and is resent until the
+//	    server acknowledges it, giving at-least-once delivery.
+//	batch - The maximum number of lines in a message. Defaults to 100.
+//	interval - The maximum time a line waits before it is sent. Defaults to
+//	    1s.
+//	retries - The number of times a message is resent after a write error or
+//	    a missing ack before it is dropped. Defaults to 3.
+//	backoff - The delay before the first retry, which doubles with each
+//	    attempt until a message is sent. While waiting to reconnect, messages
+//	    are dropped without attempting to connect. Defaults to 100ms.
+//	maxbackoff - The maximum delay between attempts. Defaults to 30s.
+//	timeout - The timeout for connecting, writing and waiting for an ack.
+//	    Defaults to 5s.
+//	transport - tcp or tls. Defaults to tcp.
+//	key.<name> - Overrides the key used for the given element of the record,
+//	    as with format=json. Unless key.fields is set, fields are added at the
+//	    top level and are prefixed with "fields." if they collide with another
+//	    key.
+//
+// The TLS parameters described for tls:// outputs are also accepted when using
+// the tls transport.
+func newOutputFuncFluent(u *url.URL) (Output, error) {
+	if u.User != nil {
+		return nil, fmt.Errorf("Can not use a username with fluent.")
+	}
+	if u.Fragment != "" {
+		return nil, fmt.Errorf("Can not use a fragment with fluent.")
+	}
+	if u.Host != "" && u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("Can not use both a hostname and a path with fluent.")
+	} else if u.Host == "" && u.Path == "" {
+		return nil, fmt.Errorf("A hostname or path is required with fluent.")
+	}
+
+	// Parse the RawQuery so we can extract the parameters.
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &fluentOutput{
+		network:    "tcp",
+		address:    u.Host,
+		tag:        values.Get("tag"),
+		keys:       DefaultFluentKeys,
+		batchLines: fluentDefaultBatchLines,
+		interval:   fluentDefaultInterval,
+		retries:    fluentDefaultRetries,
+		backoff:    fluentDefaultBackoff,
+		maxBackoff: fluentDefaultMaxBackoff,
+		timeout:    fluentDefaultTimeout,
+	}
+	delete(values, "tag")
+	if o.tag == "" {
+		o.tag = filepath.Base(os.Args[0])
+	}
+	if u.Host == "" {
+		o.network = "unix"
+		o.address = uriPathToFilename(u.Path)
+	} else if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		o.address = net.JoinHostPort(u.Host, fluentDefaultPort)
+	}
+
+	if v := values.Get("ack"); v != "" {
+		if o.ack, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid ack setting: %s", v)
+		}
+	}
+	delete(values, "ack")
+	for param, n := range map[string]*int{
+		"batch":   &o.batchLines,
+		"retries": &o.retries,
+	} {
+		if v := values.Get(param); v != "" {
+			if *n, err = strconv.Atoi(v); err != nil || *n < 0 || (*n == 0 && param != "retries") {
+				return nil, fmt.Errorf("Invalid %s: %s", param, v)
+			}
+		}
+		delete(values, param)
+	}
+	for param, d := range map[string]*time.Duration{
+		"interval":   &o.interval,
+		"backoff":    &o.backoff,
+		"maxbackoff": &o.maxBackoff,
+		"timeout":    &o.timeout,
+	} {
+		if v := values.Get(param); v != "" {
+			if *d, err = time.ParseDuration(v); err != nil || *d <= 0 {
+				return nil, fmt.Errorf("Invalid %s: %s", param, v)
+			}
+		}
+		delete(values, param)
+	}
+	if err := parseKeyParameters(values, &o.keys); err != nil {
+		return nil, err
+	}
+	transport := values.Get("transport")
+	delete(values, "transport")
+	switch transport {
+	case "", "tcp":
+	case "tls":
+		if o.network == "unix" {
+			return nil, fmt.Errorf("Transport tls requires a hostname.")
+		}
+		if o.tlsConfig, err = parseTLSConfig(u, values); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown fluent transport: %s", transport)
+	}
+
+	// Check that nothing else was defined.
+	if len(values) != 0 {
+		bad := make([]string, 0, len(values))
+		for k, _ := range values {
+			bad = append(bad, k)
+		}
+		return nil, fmt.Errorf("Unknown parameters: %s", strings.Join(bad, ","))
+	}
+
+	return o, nil
+}
+
+// Adds a line to the current batch, sending the batch if it is full.
+func (o *fluentOutput) Write(ld *LineData) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	e := msgpackEncoder{&o.entries}
+	e.writeArrayHeader(2)
+	e.writeEventTime(ld.TimeStamp)
+	o.record(e, ld)
+	o.lines++
+	if o.lines >= o.batchLines {
+		return o.send()
+	} else if o.timer == nil {
+		o.timer = time.AfterFunc(o.interval, o.timedFlush)
+	}
+	return nil
+}
+
+// Sends the current batch immediately.
+func (o *fluentOutput) Flush() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.send()
+}
+
+// Forces the connection to be re-established on the next send.
+func (o *fluentOutput) Reopen() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.disconnect()
+	o.delay = 0
+	o.nextAttempt = time.Time{}
+	return nil
+}
+
+// Sends the current batch and then closes the connection.
+func (o *fluentOutput) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	err := o.send()
+	o.disconnect()
+	return err
+}
+
+// Called by the timer to send the batch once the interval has elapsed.
+func (o *fluentOutput) timedFlush() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.send()
+}
+
+// Encodes the record for a line as a map.
+func (o *fluentOutput) record(e msgpackEncoder, ld *LineData) {
+	keys := make([]string, 0, 8+len(ld.Fields))
+	values := make([]interface{}, 0, 8+len(ld.Fields))
+	used := make(map[string]bool, 8)
+	member := func(key string, value interface{}) {
+		if key != "" {
+			keys = append(keys, key)
+			values = append(values, value)
+			used[key] = true
+		}
+	}
+
+	member(o.keys.Time, ld.TimeStamp.Format(time.RFC3339Nano))
+	member(o.keys.Class, ld.Class.String())
+	member(o.keys.Message, ld.Message)
+	member(o.keys.Package, ld.CallingPackage)
+	member(o.keys.Function, ld.CallingFunction)
+	member(o.keys.SourceFile, ld.SourceFile)
+	member(o.keys.SourceLine, ld.SourceLine)
+	member(o.keys.Caller, caller(ld))
+	if ld.Name != "" {
+		member(o.keys.Name, ld.Name)
+	}
+	if o.keys.Fields != "" {
+		member(o.keys.Fields, ld.Fields)
+	} else {
+		for _, k := range sortedFieldKeys(ld.Fields) {
+			key := k
+			if used[key] {
+				key = "fields." + k
+			}
+			member(key, ld.Fields[k])
+		}
+	}
+
+	e.writeMapHeader(len(keys))
+	for i, k := range keys {
+		e.writeString(k)
+		e.writeValue(values[i])
+	}
+}
+
+// Sends the current batch as a PackedForward message and starts a new one.
+// The batch is discarded if it can not be sent after retrying. This must be
+// called with the mutex held.
+func (o *fluentOutput) send() error {
+	if o.timer != nil {
+		o.timer.Stop()
+		o.timer = nil
+	}
+	if o.lines == 0 {
+		return nil
+	}
+	defer func() {
+		o.entries.Reset()
+		o.lines = 0
+	}()
+
+	var chunk string
+	options := 1
+	if o.ack {
+		var id [16]byte
+		rand.Read(id[:])
+		chunk = base64.StdEncoding.EncodeToString(id[:])
+		options++
+	}
+	var message bytes.Buffer
+	e := msgpackEncoder{&message}
+	e.writeArrayHeader(3)
+	e.writeString(o.tag)
+	e.writeBin(o.entries.Bytes())
+	e.writeMapHeader(options)
+	e.writeString("size")
+	e.writeInt(int64(o.lines))
+	if o.ack {
+		e.writeString("chunk")
+		e.writeString(chunk)
+	}
+
+	for attempt := 0; ; attempt++ {
+		// Failing to connect is not retried, as the backoff then applies to
+		// the following batches as well.
+		if err := o.connect(); err != nil {
+			return err
+		}
+		err := o.attempt(message.Bytes(), chunk)
+		if err == nil {
+			o.delay = 0
+			return nil
+		}
+		o.disconnect()
+		o.scheduleReconnect()
+		if attempt >= o.retries {
+			return err
+		}
+		time.Sleep(o.delay)
+	}
+}
+
+// Makes a single attempt to send a message on the current connection, waiting
+// for the server to acknowledge the chunk if it is not empty.
+func (o *fluentOutput) attempt(message []byte, chunk string) error {
+	o.conn.SetWriteDeadline(time.Now().Add(o.timeout))
+	if _, err := o.conn.Write(message); err != nil {
+		return err
+	}
+	if chunk == "" {
+		return nil
+	}
+
+	o.conn.SetReadDeadline(time.Now().Add(o.timeout))
+	response, err := msgpackDecoder{o.reader}.decode()
+	if err != nil {
+		return err
+	}
+	if m, ok := response.(map[string]interface{}); !ok || m["ack"] != chunk {
+		return fmt.Errorf("Unexpected response from fluent server: %v", response)
+	}
+	return nil
+}
+
+// Connects to the server if not already connected. This fails without
+// attempting to connect if the backoff has not elapsed.
+func (o *fluentOutput) connect() error {
+	if o.conn != nil {
+		return nil
+	} else if time.Now().Before(o.nextAttempt) {
+		return fmt.Errorf("Waiting to reconnect to the fluent server at %s.", o.address)
+	}
+	dialer := &net.Dialer{Timeout: o.timeout}
+	var conn net.Conn
+	var err error
+	if o.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, o.network, o.address, o.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(o.network, o.address)
+	}
+	if err != nil {
+		o.scheduleReconnect()
+		return err
+	}
+	o.conn = conn
+	o.reader = bufio.NewReader(conn)
+	return nil
+}
+
+// Delays the next connection attempt, doubling the delay each time.
+func (o *fluentOutput) scheduleReconnect() {
+	if o.delay == 0 {
+		o.delay = o.backoff
+	} else if o.delay *= 2; o.delay > o.maxBackoff {
+		o.delay = o.maxBackoff
+	}
+	o.nextAttempt = time.Now().Add(o.delay)
+}
+
+// Closes the current connection, if any.
+func (o *fluentOutput) disconnect() {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+		o.reader = nil
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Forward protocol message received by testFluentServer.
+type testFluentMessage struct {
+	// The index of the connection the message arrived on.
+	conn int
+
+	tag     string
+	entries []interface{}
+	options map[string]interface{}
+}
+
+// A stand-in Forward server which decodes PackedForward messages and
+// acknowledges chunks, except that the first dropAcks chunks are answered by
+// closing the connection instead.
+type testFluentServer struct {
+	listener net.Listener
+	messages chan testFluentMessage
+
+	mutex    sync.Mutex
+	dropAcks int
+	conns    int
+}
+
+func newTestFluentServer(t *testing.T, dropAcks int) *testFluentServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testFluentServer{
+		listener: l,
+		messages: make(chan testFluentMessage, 100),
+		dropAcks: dropAcks,
+	}
+	go s.serve()
+	return s
+}
+
+func (s *testFluentServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns++
+		index := s.conns
+		s.mutex.Unlock()
+		go s.handle(conn, index)
+	}
+}
+
+func (s *testFluentServer) handle(conn net.Conn, index int) {
+	defer conn.Close()
+	d := msgpackDecoder{bufio.NewReader(conn)}
+	for {
+		v, err := d.decode()
+		if err != nil {
+			return
+		}
+		a, ok := v.([]interface{})
+		if !ok || len(a) != 3 {
+			return
+		}
+		msg := testFluentMessage{conn: index}
+		msg.tag, _ = a[0].(string)
+		msg.options, _ = a[2].(map[string]interface{})
+		packed, _ := a[1].([]byte)
+		entries := msgpackDecoder{bufio.NewReader(bytes.NewReader(packed))}
+		for {
+			entry, err := entries.decode()
+			if err != nil {
+				break
+			}
+			msg.entries = append(msg.entries, entry)
+		}
+		s.messages <- msg
+
+		chunk, ok := msg.options["chunk"].(string)
+		if !ok {
+			continue
+		}
+		s.mutex.Lock()
+		drop := s.dropAcks > 0
+		s.dropAcks--
+		s.mutex.Unlock()
+		if drop {
+			return
+		}
+		var b bytes.Buffer
+		e := msgpackEncoder{&b}
+		e.writeMapHeader(1)
+		e.writeString("ack")
+		e.writeString(chunk)
+		conn.Write(b.Bytes())
+	}
+}
+
+func (s *testFluentServer) next(t *testing.T) testFluentMessage {
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a message.")
+	}
+	return testFluentMessage{}
+}
+
+func TestFluentPackedForward(t *testing.T) {
+	s := newTestFluentServer(t, 0)
+	defer s.listener.Close()
+
+	o := newTestOutput(t, newOutputFuncFluent,
+		"fluent://"+s.listener.Addr().String()+"?tag=app.api&interval=1h").(*fluentOutput)
+	defer o.Close()
+	o.Write(&LineData{
+		Message:    "one",
+		Class:      WARN,
+		TimeStamp:  time.Unix(100, 5),
+		SourceFile: "main.go",
+		SourceLine: 7,
+		Name:       "db",
+		Fields:     map[string]interface{}{"user": "bob", "count": 3, "message": "dup"},
+	})
+	o.Write(&LineData{Message: "two", Class: INFO, TimeStamp: time.Unix(101, 0)})
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := s.next(t)
+	if msg.tag != "app.api" {
+		t.Fatalf("Expected tag app.api, got %q", msg.tag)
+	} else if len(msg.entries) != 2 || msg.options["size"] != int64(2) {
+		t.Fatalf("Expected 2 entries, got %d and %v", len(msg.entries), msg.options)
+	} else if _, ok := msg.options["chunk"]; ok {
+		t.Fatalf("Expected no chunk without ack.")
+	}
+
+	entry := msg.entries[0].([]interface{})
+	if ext, ok := entry[0].(msgpackExt); !ok || ext.Type != msgpackEventTimeType ||
+		!bytes.Equal(ext.Data, []byte{0, 0, 0, 100, 0, 0, 0, 5}) {
+		t.Fatalf("Unexpected time %#v", entry[0])
+	}
+	record := entry[1].(map[string]interface{})
+	expected := map[string]interface{}{
+		"class":            "warn",
+		"message":          "one",
+		"calling_package":  "",
+		"calling_function": "",
+		"source_file":      "main.go",
+		"source_line":      int64(7),
+		"name":             "db",
+		"user":             "bob",
+		"count":            int64(3),
+		"fields.message":   "dup",
+	}
+	if len(record) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, record)
+	}
+	for k, v := range expected {
+		if record[k] != v {
+			t.Fatalf("Expected %s to be %#v, got %#v", k, v, record[k])
+		}
+	}
+}
+
+func TestFluentBatchLines(t *testing.T) {
+	s := newTestFluentServer(t, 0)
+	defer s.listener.Close()
+
+	o := newTestOutput(t, newOutputFuncFluent,
+		"fluent://"+s.listener.Addr().String()+"?batch=2&interval=1h").(*fluentOutput)
+	defer o.Close()
+	for _, m := range []string{"one", "two", "three"} {
+		o.Write(&LineData{Message: m, Class: INFO, TimeStamp: time.Now()})
+	}
+	if msg := s.next(t); len(msg.entries) != 2 {
+		t.Fatalf("Expected a full batch of 2, got %d", len(msg.entries))
+	}
+	select {
+	case <-s.messages:
+		t.Fatalf("Expected the third line to wait for a flush.")
+	default:
+	}
+	o.Flush()
+	if msg := s.next(t); len(msg.entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(msg.entries))
+	}
+}
+
+func TestFluentInterval(t *testing.T) {
+	s := newTestFluentServer(t, 0)
+	defer s.listener.Close()
+
+	o := newTestOutput(t, newOutputFuncFluent,
+		"fluent://"+s.listener.Addr().String()+"?interval=10ms").(*fluentOutput)
+	defer o.Close()
+	o.Write(&LineData{Message: "one", Class: INFO, TimeStamp: time.Now()})
+	if msg := s.next(t); len(msg.entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(msg.entries))
+	}
+}
+
+func TestFluentAck(t *testing.T) {
+	s := newTestFluentServer(t, 0)
+	defer s.listener.Close()
+
+	o := newTestOutput(t, newOutputFuncFluent,
+		"fluent://"+s.listener.Addr().String()+"?ack=true").(*fluentOutput)
+	defer o.Close()
+	for _, m := range []string{"one", "two"} {
+		o.Write(&LineData{Message: m, Class: INFO, TimeStamp: time.Now()})
+		if err := o.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, second := s.next(t), s.next(t)
+	if first.options["chunk"] == nil || first.options["chunk"] == second.options["chunk"] {
+		t.Fatalf("Expected a unique chunk for each message, got %v and %v",
+			first.options, second.options)
+	} else if first.conn != 1 || second.conn != 1 {
+		t.Fatalf("Expected the connection to be reused.")
+	}
+}
+
+func TestFluentAckRetry(t *testing.T) {
+	s := newTestFluentServer(t, 1)
+	defer s.listener.Close()
+
+	o := newTestOutput(t, newOutputFuncFluent,
+		"fluent://"+s.listener.Addr().String()+"?ack=true&backoff=1ms").(*fluentOutput)
+	defer o.Close()
+	o.Write(&LineData{Message: "one", Class: INFO, TimeStamp: time.Now()})
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first attempt is not acknowledged, so the same chunk is resent on a
+	// new connection.
+	first, second := s.next(t), s.next(t)
+	if first.options["chunk"] != second.options["chunk"] {
+		t.Fatalf("Expected the same chunk to be resent.")
+	} else if first.conn != 1 || second.conn != 2 {
+		t.Fatalf("Expected a new connection, got %d and %d", first.conn, second.conn)
+	}
+}
+
+func TestFluentAckGiveUp(t *testing.T) {
+	s := newTestFluentServer(t, 3)
+	defer s.listener.Close()
+
+	o := newTestOutput(t, newOutputFuncFluent, "fluent://"+s.listener.Addr().String()+
+		"?ack=true&backoff=1ms&retries=2").(*fluentOutput)
+	defer o.Close()
+	o.Write(&LineData{Message: "one", Class: INFO, TimeStamp: time.Now()})
+	if err := o.Flush(); err == nil {
+		t.Fatalf("Expected an error.")
+	}
+	for i := 0; i < 3; i++ {
+		s.next(t)
+	}
+	if o.lines != 0 {
+		t.Fatalf("Expected the batch to be discarded.")
+	}
+}
+
+func TestFluentBackoff(t *testing.T) {
+	// Find a free port, and then close it so that connecting fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	o := newTestOutput(t, newOutputFuncFluent, "fluent://"+addr+"?backoff=1h").(*fluentOutput)
+	defer o.Close()
+	o.Write(&LineData{Message: "one", Class: INFO, TimeStamp: time.Now()})
+	if err := o.Flush(); err == nil {
+		t.Fatalf("Expected an error.")
+	}
+
+	// Later batches are dropped without connecting until the backoff elapses.
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	o.Write(&LineData{Message: "two", Class: INFO, TimeStamp: time.Now()})
+	if err := o.Flush(); err == nil {
+		t.Fatalf("Expected an error.")
+	}
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if conn, err := l.Accept(); err == nil {
+		conn.Close()
+		t.Fatalf("Expected no connection attempt during the backoff.")
+	}
+
+	// Reopen resets the backoff.
+	o.Reopen()
+	o.Write(&LineData{Message: "three", Class: INFO, TimeStamp: time.Now()})
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFluentBadParams(t *testing.T) {
+	for _, uri := range []string{
+		"fluent://",
+		"fluent://user@localhost",
+		"fluent://localhost/path",
+		"fluent://localhost#frag",
+		"fluent://localhost?unknown=1",
+		"fluent://localhost?ack=maybe",
+		"fluent://localhost?batch=0",
+		"fluent://localhost?interval=soon",
+		"fluent://localhost?transport=udp",
+		"fluent://localhost?ca=ca.pem",
+		"fluent://localhost?key.unknown=x",
+		"fluent:///var/run/fluent.sock?transport=tls",
+	} {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newOutputFuncFluent(u); err == nil {
+			t.Fatalf("Expected an error for %s", uri)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The default port used when a GELF host is given without one.
+	gelfDefaultPort = "12201"
+
+	// The default maximum size of a UDP datagram, which is suitable for most
+	// networks. Larger messages are split into chunks of this size.
+	gelfDefaultChunkSize = 1420
+
+	// The size of the header at the start of each chunk, and the maximum
+	// number of chunks a message can be split into.
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+)
+
+// The magic bytes which start each chunk of a chunked GELF message.
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// An implementation of Output which sends log lines to Graylog, or any other
+// server which accepts GELF 1.1 messages, over UDP or TCP.
+type gelfOutput struct {
+	// The connection that messages are written to.
+	writer *netWriter
+
+	// If true messages are sent over UDP, compressed and chunked as needed,
+	// otherwise they are sent over a stream terminated with a null byte.
+	udp bool
+
+	// The compression used for UDP messages: none, gzip or zlib.
+	compress string
+
+	// The maximum size of each UDP datagram.
+	chunkSize int
+
+	// The ID of the next chunked message, which starts at a random value.
+	nextID uint64
+
+	// The value of the host member of each message.
+	host string
+
+	// Used to render the short_message of each message.
+	formatter *ioOutput
+}
+
+// Parses a URL that starts with gelf://
+//
+// Messages are sent to the given host, using port 12201 if none is given, for
+// example gelf://graylog:12201. Each line is encoded as a GELF 1.1 message
+// where the level is the syslog severity of the line's class, the source file
+// and line, function, package and logger name are sent as the _file, _line,
+// _function, _package and _logger fields, and each member of Fields is sent
+// with a '_' prefix. The stack attached to ERROR lines is sent as the
+// full_message. The query may contain the following parameters:
+//
+//	transport - udp, tcp or tls. Defaults to udp.
+//	compress - none, gzip or zlib. Only UDP messages can be compressed.
+//	    Defaults to gzip for udp and none otherwise.
+//	chunksize - The maximum size of each UDP datagram. Larger messages are
+//	    split into up to 128 chunks. Defaults to 1420.
+//	hostname - Overrides the reported host name.
+//	format - A format string for the short_message. See NewIOWriterOutput.
+//	    Defaults to "%message%".
+//
+// The buffer, backoff, maxbackoff and timeout parameters described for tcp://
+// outputs are also accepted, as are the TLS parameters described for tls://
+// outputs when using the tls transport.
+func newOutputFuncGELF(u *url.URL) (Output, error) {
+	if u.User != nil {
+		return nil, fmt.Errorf("Can not use a username with gelf.")
+	}
+	if u.Fragment != "" {
+		return nil, fmt.Errorf("Can not use a fragment with gelf.")
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("A hostname is required with gelf.")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("Can not use a path with gelf.")
+	}
+
+	// Parse the RawQuery so we can extract the parameters.
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the values we need for setting up the Output object.
+	transport := values.Get("transport")
+	delete(values, "transport")
+	compress := values.Get("compress")
+	delete(values, "compress")
+	chunkSize := values.Get("chunksize")
+	delete(values, "chunksize")
+	hostname := values.Get("hostname")
+	delete(values, "hostname")
+	format := values.Get("format")
+	delete(values, "format")
+
+	o := &gelfOutput{chunkSize: gelfDefaultChunkSize}
+	address := u.Host
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		address = net.JoinHostPort(u.Host, gelfDefaultPort)
+	}
+	network := "tcp"
+	switch transport {
+	case "", "udp":
+		o.udp = true
+		network = "udp"
+	case "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("Unknown gelf transport: %s", transport)
+	}
+	if o.writer, err = newNetWriter(network, address, values); err != nil {
+		return nil, err
+	}
+	if transport == "tls" {
+		if o.writer.tlsConfig, err = parseTLSConfig(u, values); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check that nothing else was defined.
+	if len(values) != 0 {
+		bad := make([]string, 0, len(values))
+		for k, _ := range values {
+			bad = append(bad, k)
+		}
+		return nil, fmt.Errorf("Unknown parameters: %s", strings.Join(bad, ","))
+	}
+
+	switch compress {
+	case "":
+		o.compress = "none"
+		if o.udp {
+			o.compress = "gzip"
+		}
+	case "none", "gzip", "zlib":
+		if !o.udp && compress != "none" {
+			return nil, fmt.Errorf("Compression requires the udp transport.")
+		}
+		o.compress = compress
+	default:
+		return nil, fmt.Errorf("Unknown gelf compression: %s", compress)
+	}
+
+	if chunkSize != "" {
+		o.chunkSize, err = strconv.Atoi(chunkSize)
+		if err != nil || o.chunkSize <= gelfChunkHeaderSize {
+			return nil, fmt.Errorf("Invalid chunk size: %s", chunkSize)
+		}
+	}
+
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	o.host = hostname
+
+	if format == "" {
+		format = "%message%"
+	}
+	if o.formatter, err = newIOOutput(nil, format, "off"); err != nil {
+		return nil, err
+	}
+
+	var id [8]byte
+	rand.Read(id[:])
+	o.nextID = binary.BigEndian.Uint64(id[:])
+
+	return o, nil
+}
+
+// Sends a single line as a GELF message.
+func (o *gelfOutput) Write(ld *LineData) error {
+	o.writer.setClass(ld.Class)
+	msg, err := o.formatter.format(ld)
+	if err != nil {
+		return err
+	}
+	b := bytes.NewBuffer(make([]byte, 0, 256+len(ld.Message)))
+	o.message(b, ld, msg.String())
+
+	if !o.udp {
+		b.WriteByte(0)
+		_, err := o.writer.Write(b.Bytes())
+		return err
+	}
+
+	data := b.Bytes()
+	if o.compress != "none" {
+		if data, err = o.compressed(data); err != nil {
+			return err
+		}
+	}
+	return o.writeChunks(data)
+}
+
+// Sends any messages buffered while disconnected.
+func (o *gelfOutput) Flush() error {
+	return o.writer.Flush()
+}
+
+// Reconnects on the next write.
+func (o *gelfOutput) Reopen() error {
+	return o.writer.Reopen()
+}
+
+// Closes the connection.
+func (o *gelfOutput) Close() error {
+	return o.writer.Close()
+}
+
+// Returns the classes of the lines dropped since the last call.
+func (o *gelfOutput) takeDropped() []LogClass {
+	return o.writer.takeDropped()
+}
+
+// Renders the GELF JSON object for the given line into the buffer.
+func (o *gelfOutput) message(b *bytes.Buffer, ld *LineData, short string) {
+	b.WriteString(`{"version":"1.1","host":`)
+	b.Write(jsonValue(o.host))
+	b.WriteString(`,"short_message":`)
+	b.Write(jsonValue(short))
+	stack, hasStack := ld.Fields["stack"].(string)
+	if hasStack {
+		b.WriteString(`,"full_message":`)
+		b.Write(jsonValue(strings.TrimPrefix(stack, "\n")))
+	}
+	b.WriteString(`,"timestamp":`)
+	b.WriteString(gelfTimestamp(ld.TimeStamp))
+	b.WriteString(`,"level":`)
+	b.WriteString(strconv.Itoa(syslogSeverity(ld.Class)))
+
+	used := make(map[string]bool, 8)
+	member := func(key string, value []byte) {
+		used[key] = true
+		b.WriteByte(',')
+		b.Write(jsonValue(key))
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	if ld.SourceFile != "" {
+		member("_file", jsonValue(ld.SourceFile))
+		member("_line", jsonValue(ld.SourceLine))
+	}
+	if ld.CallingFunction != "" {
+		member("_function", jsonValue(ld.CallingFunction))
+	}
+	if ld.CallingPackage != "" {
+		member("_package", jsonValue(ld.CallingPackage))
+	}
+	if ld.Name != "" {
+		member("_logger", jsonValue(ld.Name))
+	}
+
+	// Fields that collide with one of the members above are prefixed so they
+	// are not lost.
+	for _, k := range sortedFieldKeys(ld.Fields) {
+		if k == "stack" && hasStack {
+			continue
+		}
+		key := "_" + gelfFieldName(k)
+		if used[key] || key == "_id" {
+			key = "_fields." + gelfFieldName(k)
+		}
+		member(key, gelfValue(ld.Fields[k]))
+	}
+	b.WriteByte('}')
+}
+
+// Compresses a message with the configured compression.
+func (o *gelfOutput) compressed(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	if o.compress == "zlib" {
+		w = zlib.NewWriter(&b)
+	} else {
+		w = gzip.NewWriter(&b)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Writes a message as a single datagram if it fits, and otherwise as a series
+// of chunks. The chunks are handed to the writer together so that the message
+// is buffered or dropped as a whole.
+func (o *gelfOutput) writeChunks(data []byte) error {
+	if len(data) <= o.chunkSize {
+		_, err := o.writer.Write(data)
+		return err
+	}
+
+	size := o.chunkSize - gelfChunkHeaderSize
+	count := (len(data) + size - 1) / size
+	if count > gelfMaxChunks {
+		return fmt.Errorf("GELF message too large: %d bytes", len(data))
+	}
+	id := o.nextID
+	o.nextID++
+
+	chunks := make([][]byte, count)
+	for i := range chunks {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := make([]byte, gelfChunkHeaderSize, gelfChunkHeaderSize+end-i*size)
+		copy(chunk, gelfChunkMagic)
+		binary.BigEndian.PutUint64(chunk[2:10], id)
+		chunk[10] = byte(i)
+		chunk[11] = byte(count)
+		chunks[i] = append(chunk, data[i*size:end]...)
+	}
+	o.writer.writePackets(chunks...)
+	return nil
+}
+
+// Formats a time as seconds since the epoch with microsecond precision.
+func gelfTimestamp(t time.Time) string {
+	us, sign := t.UnixNano()/int64(time.Microsecond), ""
+	if us < 0 {
+		us, sign = -us, "-"
+	}
+	return fmt.Sprintf("%s%d.%06d", sign, us/1e6, us%1e6)
+}
+
+// Replaces characters which are not allowed in GELF field names with '_'.
+func gelfFieldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '_', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Returns the JSON for a field value. GELF only allows strings and numbers, so
+// other values are converted to strings.
+func gelfValue(v interface{}) []byte {
+	switch v.(type) {
+	case string, error, int, int8, int16, int32, int64, uint, uint8, uint16,
+		uint32, uint64, float32, float64:
+		return jsonValue(v)
+	}
+	return jsonValue(fmt.Sprint(v))
+}
@@ -0,0 +1,225 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reads datagrams until a complete GELF message has been received, and then
+// decompresses and decodes it.
+func readGELFMessage(t *testing.T, conn net.PacketConn) map[string]interface{} {
+	var chunks [][]byte
+	received := 0
+	for {
+		packet := []byte(readPacket(t, conn))
+		if !bytes.HasPrefix(packet, gelfChunkMagic) {
+			return decodeGELFMessage(t, packet)
+		}
+		seq, count := int(packet[10]), int(packet[11])
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		if chunks[seq] == nil {
+			received++
+		}
+		chunks[seq] = packet[gelfChunkHeaderSize:]
+		if received == count {
+			return decodeGELFMessage(t, bytes.Join(chunks, nil))
+		}
+	}
+}
+
+func decodeGELFMessage(t *testing.T, data []byte) map[string]interface{} {
+	var r io.Reader = bytes.NewReader(data)
+	var err error
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		r, err = gzip.NewReader(r)
+	case data[0] == 0x78:
+		r, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make(map[string]interface{})
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("Invalid message %q: %s", data, err)
+	}
+	return msg
+}
+
+func TestGELFMessage(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	o := newTestOutput(t, newOutputFuncGELF,
+		"gelf://"+conn.LocalAddr().String()+"?compress=none&hostname=box").(*gelfOutput)
+	defer o.Close()
+	ld := &LineData{
+		Message:         "failed",
+		Class:           ERROR,
+		TimeStamp:       time.Unix(1400000000, 123456789),
+		SourceFile:      "main.go",
+		SourceLine:      12,
+		CallingFunction: "main",
+		CallingPackage:  "app",
+		Name:            "db",
+		Fields: map[string]interface{}{
+			"stack":   "\n\tmain.go:12 main",
+			"count":   3,
+			"user id": "bob",
+			"file":    "other.go",
+			"id":      7,
+			"ok":      true,
+		},
+	}
+	if err := o.Write(ld); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"version":       "1.1",
+		"host":          "box",
+		"short_message": "failed",
+		"full_message":  "\tmain.go:12 main",
+		"timestamp":     1400000000.123456,
+		"level":         float64(3),
+		"_file":         "main.go",
+		"_line":         float64(12),
+		"_function":     "main",
+		"_package":      "app",
+		"_logger":       "db",
+		"_count":        float64(3),
+		"_user_id":      "bob",
+		"_fields.file":  "other.go",
+		"_fields.id":    float64(7),
+		"_ok":           "true",
+	}
+	msg := readGELFMessage(t, conn)
+	if len(msg) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, msg)
+	}
+	for k, v := range expected {
+		if msg[k] != v {
+			t.Fatalf("Expected %s to be %#v, got %#v", k, v, msg[k])
+		}
+	}
+}
+
+func TestGELFChunked(t *testing.T) {
+	for _, compress := range []string{"none", "gzip", "zlib"} {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		o := newTestOutput(t, newOutputFuncGELF, "gelf://"+conn.LocalAddr().String()+
+			"?chunksize=100&compress="+compress).(*gelfOutput)
+		defer o.Close()
+
+		// Use a message that does not compress well so that it is chunked.
+		var message bytes.Buffer
+		for i := 0; message.Len() < 2000; i++ {
+			message.WriteString(time.Unix(int64(i*7919), 0).UTC().Format(time.RFC3339Nano))
+		}
+		if err := o.Write(&LineData{Message: message.String(), Class: INFO}); err != nil {
+			t.Fatal(err)
+		}
+		msg := readGELFMessage(t, conn)
+		if msg["short_message"] != message.String() {
+			t.Fatalf("Expected the message to be reassembled with %s", compress)
+		} else if msg["level"] != float64(6) {
+			t.Fatalf("Expected level 6, got %v", msg["level"])
+		}
+	}
+}
+
+func TestGELFTooManyChunks(t *testing.T) {
+	o := newTestOutput(t, newOutputFuncGELF,
+		"gelf://127.0.0.1:1?chunksize=13&compress=none").(*gelfOutput)
+	defer o.Close()
+	err := o.Write(&LineData{Message: strings.Repeat("x", 200), Class: INFO})
+	if err == nil {
+		t.Fatalf("Expected an error.")
+	}
+}
+
+func TestGELFTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	o := newTestOutput(t, newOutputFuncGELF,
+		"gelf://"+l.Addr().String()+"?transport=tcp").(*gelfOutput)
+	defer o.Close()
+	for _, m := range []string{"one", "two"} {
+		ld := &LineData{Message: m, Class: WARN, TimeStamp: time.Now()}
+		if err := o.Write(ld); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, m := range []string{"one", "two"} {
+		data, err := r.ReadBytes(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := decodeGELFMessage(t, data[:len(data)-1])
+		if msg["short_message"] != m || msg["level"] != float64(4) {
+			t.Fatalf("Unexpected message %v", msg)
+		}
+	}
+}
+
+func TestGELFBadParams(t *testing.T) {
+	for _, uri := range []string{
+		"gelf://",
+		"gelf://user@localhost",
+		"gelf://localhost/path",
+		"gelf://localhost#frag",
+		"gelf://localhost?unknown=1",
+		"gelf://localhost?transport=sctp",
+		"gelf://localhost?compress=lzma",
+		"gelf://localhost?transport=tcp&compress=gzip",
+		"gelf://localhost?chunksize=12",
+		"gelf://localhost?timeout=0s",
+		"gelf://localhost?ca=ca.pem",
+	} {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newOutputFuncGELF(u); err == nil {
+			t.Fatalf("Expected an error for %s", uri)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HTTPEncoder builds the body of the requests made by http:// and https://
+// outputs. Lines are encoded one at a time as they are written, so that the
+// size of the batch is known, and then the body is completed with Finish
+// before it is sent. An HTTPEncoder is only used by a single output, and is
+// never called concurrently.
+type HTTPEncoder interface {
+	// Returns the Content-Type of the request body.
+	ContentType() string
+
+	// Appends a line to the batch in the buffer, which is empty for the first
+	// line of each batch.
+	Encode(b *bytes.Buffer, ld *LineData)
+
+	// Completes the body of a batch of one or more lines.
+	Finish(b *bytes.Buffer)
+}
+
+// Function used to create a new HTTPEncoder from the parameters in the URL of
+// an output. Any parameters used must be removed from values.
+type NewHTTPEncoderFunc func(values url.Values) (HTTPEncoder, error)
+
+var (
+	// The known encoders by name, protected by httpEncoderMutex.
+	httpEncoderMap = map[string]NewHTTPEncoderFunc{
+		"ndjson":        newNDJSONEncoder,
+		"elasticsearch": newElasticsearchEncoder,
+		"loki":          newLokiEncoder,
+	}
+	httpEncoderMutex sync.RWMutex
+)
+
+// AddHTTPEncoder adds an encoder which can be selected with the "encoder"
+// parameter of http:// and https:// outputs. This returns false if an encoder
+// with the given name already exists.
+func AddHTTPEncoder(name string, f NewHTTPEncoderFunc) bool {
+	httpEncoderMutex.Lock()
+	defer httpEncoderMutex.Unlock()
+	if _, ok := httpEncoderMap[name]; ok {
+		return false
+	}
+	httpEncoderMap[name] = f
+	return true
+}
+
+// Encodes each line as a JSON object followed by a newline, using the keys
+// given by key.<name> parameters as with format=json.
+type ndjsonEncoder struct {
+	json jsonOutput
+}
+
+// Creates the "ndjson" encoder.
+func newNDJSONEncoder(values url.Values) (HTTPEncoder, error) {
+	e := &ndjsonEncoder{json: jsonOutput{keys: DefaultJSONKeys}}
+	if err := parseKeyParameters(values, &e.json.keys); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Returns the Content-Type for newline delimited JSON.
+func (e *ndjsonEncoder) ContentType() string {
+	return "application/x-ndjson"
+}
+
+// Appends the line as JSON.
+func (e *ndjsonEncoder) Encode(b *bytes.Buffer, ld *LineData) {
+	e.json.format(ld, b)
+	b.WriteByte('\n')
+}
+
+// Nothing is needed to complete the body.
+func (e *ndjsonEncoder) Finish(b *bytes.Buffer) {}
+
+// Encodes lines as the body of an Elasticsearch _bulk request, where each
+// line is preceded by an index action. The "index" parameter names the index
+// for each document, and may be omitted if the URL names the index instead.
+// Keys may be changed with key.<name> parameters as with format=json.
+type elasticsearchEncoder struct {
+	ndjsonEncoder
+
+	// The action line written before each document.
+	action []byte
+}
+
+// Creates the "elasticsearch" encoder.
+func newElasticsearchEncoder(values url.Values) (HTTPEncoder, error) {
+	e := &elasticsearchEncoder{ndjsonEncoder: ndjsonEncoder{json: jsonOutput{keys: DefaultJSONKeys}}}
+	if err := parseKeyParameters(values, &e.json.keys); err != nil {
+		return nil, err
+	}
+	if index := values.Get("index"); index != "" {
+		e.action = []byte(`{"index":{"_index":` + string(jsonValue(index)) + "}}\n")
+	} else {
+		e.action = []byte("{\"index\":{}}\n")
+	}
+	delete(values, "index")
+	return e, nil
+}
+
+// Appends the index action followed by the line as JSON.
+func (e *elasticsearchEncoder) Encode(b *bytes.Buffer, ld *LineData) {
+	b.Write(e.action)
+	e.ndjsonEncoder.Encode(b, ld)
+}
+
+// The labels used for a line which would otherwise have none, as Loki rejects
+// streams without any labels.
+var lokiDefaultLabels = map[string]string{"job": "logray"}
+
+// Encodes lines as a Loki push request. Each line is sent as its own stream
+// whose labels are the static labels given by label.<name> parameters along
+// with the values of any fields named in the comma separated "labels"
+// parameter. Lines which end up with no labels, because they have none of the
+// fields named and there are no static labels, are given the label
+// job=logray. The log line itself is the JSON object written by format=json,
+// whose keys may be changed with key.<name> parameters.
+type lokiEncoder struct {
+	json jsonOutput
+
+	// The static labels added to every stream.
+	labels map[string]string
+
+	// The fields whose values are used as labels.
+	fieldLabels []string
+}
+
+// Creates the "loki" encoder.
+func newLokiEncoder(values url.Values) (HTTPEncoder, error) {
+	e := &lokiEncoder{
+		json:   jsonOutput{keys: DefaultJSONKeys},
+		labels: make(map[string]string),
+	}
+	if err := parseKeyParameters(values, &e.json.keys); err != nil {
+		return nil, err
+	}
+	for k, v := range values {
+		if strings.HasPrefix(k, "label.") {
+			e.labels[k[6:]] = v[0]
+			delete(values, k)
+		}
+	}
+	if v := values.Get("labels"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				e.fieldLabels = append(e.fieldLabels, field)
+			}
+		}
+	}
+	delete(values, "labels")
+	if len(e.labels) == 0 && len(e.fieldLabels) == 0 {
+		return nil, fmt.Errorf("Loki requires at least one label.")
+	}
+	return e, nil
+}
+
+// Returns the Content-Type for JSON.
+func (e *lokiEncoder) ContentType() string {
+	return "application/json"
+}
+
+// Appends a stream containing the line.
+func (e *lokiEncoder) Encode(b *bytes.Buffer, ld *LineData) {
+	if b.Len() == 0 {
+		b.WriteString(`{"streams":[`)
+	} else {
+		b.WriteByte(',')
+	}
+
+	labels := e.labels
+	if len(e.fieldLabels) > 0 {
+		labels = make(map[string]string, len(e.labels)+len(e.fieldLabels))
+		for k, v := range e.labels {
+			labels[k] = v
+		}
+		for _, field := range e.fieldLabels {
+			if v, ok := ld.Fields[field]; ok {
+				labels[field] = fmt.Sprint(v)
+			}
+		}
+	}
+	if len(labels) == 0 {
+		labels = lokiDefaultLabels
+	}
+
+	line := bytes.NewBuffer(make([]byte, 0, 256+len(ld.Message)))
+	e.json.format(ld, line)
+	b.WriteString(`{"stream":`)
+	b.Write(jsonValue(labels))
+	b.WriteString(`,"values":[["`)
+	b.WriteString(strconv.FormatInt(ld.TimeStamp.UnixNano(), 10))
+	b.WriteString(`",`)
+	b.Write(jsonValue(line.String()))
+	b.WriteString("]]}")
+}
+
+// Closes the list of streams.
+func (e *lokiEncoder) Finish(b *bytes.Buffer) {
+	b.WriteString("]}")
+}
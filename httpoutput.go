@@ -0,0 +1,344 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The default limits on the size of a batch. A batch is sent as soon as
+	// any of these are reached.
+	httpDefaultBatchLines = 100
+	httpDefaultBatchBytes = 1024 * 1024
+	httpDefaultInterval   = time.Second
+
+	// The default number of times a failed request is retried, the delay
+	// before the first retry, which doubles with each attempt, and the maximum
+	// delay between retries.
+	httpDefaultRetries    = 3
+	httpDefaultBackoff    = 100 * time.Millisecond
+	httpDefaultMaxBackoff = 30 * time.Second
+
+	// The default timeout for each request.
+	httpDefaultTimeout = 10 * time.Second
+)
+
+// Parses a URL that starts with http:// or https://
+//
+// Lines are collected into batches which are encoded and sent as the body of a
+// POST request to the URL, without the parameters below. A username and
+// password in the URL are sent using basic authentication. The query may
+// contain the following parameters:
+//
+//	encoder - The name of the HTTPEncoder used to build the body of each
+//	    request (see AddHTTPEncoder). Defaults to "ndjson".
+//	batch - The maximum number of lines in a batch. Defaults to 100.
+//	bytes - The size of the encoded batch at which it is sent. Defaults to
+//	    1MiB.
+//	interval - The maximum time a line waits before its batch is sent.
+//	    Defaults to 1s.
+//	gzip - If true request bodies are compressed with gzip.
+//	retries - The number of times a request is retried after a connection
+//	    error or a 429 or 5xx response. Defaults to 3.
+//	backoff - The delay before the first retry, which doubles with each
+//	    attempt. A longer Retry-After in the response is respected. Defaults
+//	    to 100ms.
+//	maxbackoff - The maximum delay between retries, which also limits the
+//	    delay requested by Retry-After. Defaults to 30s.
+//	timeout - The timeout for each request. Defaults to 10s.
+//	header.<name> - Sets the given header on each request, for example
+//	    header.Authorization=Bearer%20abc.
+//
+// The https scheme also accepts the ca, cert, key, servername and insecure
+// parameters described for tls:// outputs. Any parameters used by the encoder
+// are also accepted, for example:
+//
+//	https://es:9200/_bulk?encoder=elasticsearch&index=logs&gzip=true
+//	http://loki:3100/loki/api/v1/push?encoder=loki&label.job=app&labels=host
+func newOutputFuncHTTP(u *url.URL) (Output, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("A hostname is required with %s.", u.Scheme)
+	}
+	if u.Fragment != "" {
+		return nil, fmt.Errorf("Can not use a fragment with %s.", u.Scheme)
+	}
+
+	// Parse the RawQuery so we can extract the parameters.
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &httpOutput{
+		header:     make(http.Header),
+		batchLines: httpDefaultBatchLines,
+		batchBytes: httpDefaultBatchBytes,
+		interval:   httpDefaultInterval,
+		retries:    httpDefaultRetries,
+		backoff:    httpDefaultBackoff,
+		maxBackoff: httpDefaultMaxBackoff,
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	o.client = &http.Client{Transport: transport, Timeout: httpDefaultTimeout}
+
+	name := values.Get("encoder")
+	delete(values, "encoder")
+	if name == "" {
+		name = "ndjson"
+	}
+	httpEncoderMutex.RLock()
+	f, ok := httpEncoderMap[name]
+	httpEncoderMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown encoder: %s", name)
+	}
+	if o.encoder, err = f(values); err != nil {
+		return nil, err
+	}
+
+	for param, n := range map[string]*int{
+		"batch":   &o.batchLines,
+		"bytes":   &o.batchBytes,
+		"retries": &o.retries,
+	} {
+		if v := values.Get(param); v != "" {
+			if *n, err = strconv.Atoi(v); err != nil || *n < 0 || (*n == 0 && param != "retries") {
+				return nil, fmt.Errorf("Invalid %s: %s", param, v)
+			}
+		}
+		delete(values, param)
+	}
+	for param, d := range map[string]*time.Duration{
+		"interval":   &o.interval,
+		"backoff":    &o.backoff,
+		"maxbackoff": &o.maxBackoff,
+		"timeout":    &o.client.Timeout,
+	} {
+		if v := values.Get(param); v != "" {
+			if *d, err = time.ParseDuration(v); err != nil || *d <= 0 {
+				return nil, fmt.Errorf("Invalid %s: %s", param, v)
+			}
+		}
+		delete(values, param)
+	}
+	if v := values.Get("gzip"); v != "" {
+		if o.gzip, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid gzip setting: %s", v)
+		}
+	}
+	delete(values, "gzip")
+	for k, v := range values {
+		if strings.HasPrefix(k, "header.") {
+			o.header[http.CanonicalHeaderKey(k[7:])] = v
+			delete(values, k)
+		}
+	}
+	if u.Scheme == "https" {
+		if transport.TLSClientConfig, err = parseTLSConfig(u, values); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check that nothing else was defined.
+	if len(values) != 0 {
+		bad := make([]string, 0, len(values))
+		for k, _ := range values {
+			bad = append(bad, k)
+		}
+		return nil, fmt.Errorf("Unknown parameters: %s", strings.Join(bad, ","))
+	}
+
+	endpoint := *u
+	endpoint.RawQuery = ""
+	if u.User != nil {
+		o.username = u.User.Username()
+		o.password, _ = u.User.Password()
+		endpoint.User = nil
+	}
+	o.endpoint = endpoint.String()
+	return o, nil
+}
+
+// An implementation of Output that sends batches of lines to an HTTP endpoint.
+// Batches are sent when they reach a number of lines or bytes, once the oldest
+// line in the batch has waited for the interval, or when the output is
+// flushed. As the interval is handled by a timer the batch is protected by a
+// mutex, which is released while a batch is sent so that the next batch can be
+// filled in the meantime.
+type httpOutput struct {
+	// The URL that batches are sent to, and the credentials used for basic
+	// authentication if the username is not empty.
+	endpoint string
+	username string
+	password string
+
+	// The client used to send requests, and the extra headers added to each.
+	client *http.Client
+	header http.Header
+
+	// Encodes the body of each request.
+	encoder HTTPEncoder
+
+	// If true request bodies are compressed with gzip.
+	gzip bool
+
+	// The limits which cause the current batch to be sent.
+	batchLines int
+	batchBytes int
+	interval   time.Duration
+
+	// The number of retries after a failed request, and the initial and
+	// maximum delays between them.
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	// Held while a batch is being sent so that batches are sent in order. It
+	// is acquired before mutex is released, and mutex is never acquired while
+	// holding it.
+	sendMutex sync.Mutex
+
+	// Protects the fields below.
+	mutex sync.Mutex
+
+	// The encoded lines of the current batch, and the number of lines in it.
+	batch bytes.Buffer
+	lines int
+
+	// Sends the current batch once the interval has elapsed, or nil if the
+	// batch is empty.
+	timer *time.Timer
+}
+
+// Adds a line to the current batch, sending the batch if it is full.
+func (o *httpOutput) Write(ld *LineData) error {
+	o.mutex.Lock()
+	o.encoder.Encode(&o.batch, ld)
+	o.lines++
+	if o.lines >= o.batchLines || o.batch.Len() >= o.batchBytes {
+		return o.send()
+	} else if o.timer == nil {
+		o.timer = time.AfterFunc(o.interval, o.timedFlush)
+	}
+	o.mutex.Unlock()
+	return nil
+}
+
+// Sends the current batch immediately, waiting for any batch which is already
+// being sent.
+func (o *httpOutput) Flush() error {
+	o.mutex.Lock()
+	return o.send()
+}
+
+// Sends the current batch and closes any idle connections. The output can
+// still be written to afterwards, which starts a new batch.
+func (o *httpOutput) Close() error {
+	err := o.Flush()
+	o.client.CloseIdleConnections()
+	return err
+}
+
+// Called by the timer to send the batch once the interval has elapsed.
+func (o *httpOutput) timedFlush() {
+	o.mutex.Lock()
+	o.send()
+}
+
+// Sends the current batch and starts a new one. The batch is discarded if it
+// can not be sent after retrying. This must be called with the mutex held,
+// which is released once the batch has been taken so that it is not held while
+// waiting to retry.
+func (o *httpOutput) send() error {
+	if o.timer != nil {
+		o.timer.Stop()
+		o.timer = nil
+	}
+	var body []byte
+	if o.lines > 0 {
+		o.encoder.Finish(&o.batch)
+		body = append([]byte(nil), o.batch.Bytes()...)
+		o.batch.Reset()
+		o.lines = 0
+	}
+	o.sendMutex.Lock()
+	defer o.sendMutex.Unlock()
+	o.mutex.Unlock()
+	if body == nil {
+		return nil
+	}
+
+	if o.gzip {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(body)
+		gz.Close()
+		body = compressed.Bytes()
+	}
+
+	delay := o.backoff
+	for attempt := 0; ; attempt++ {
+		retry, after, err := o.post(body)
+		if err == nil || !retry || attempt >= o.retries {
+			return err
+		}
+		if after > delay {
+			delay = after
+		}
+		if delay > o.maxBackoff {
+			delay = o.maxBackoff
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Makes a single request with the given body. If it fails this returns
+// whether it can be retried, along with any delay requested by the server.
+func (o *httpOutput) post(body []byte) (retry bool, after time.Duration, err error) {
+	req, err := http.NewRequest("POST", o.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Content-Type", o.encoder.ContentType())
+	if o.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if o.username != "" {
+		req.SetBasicAuth(o.username, o.password)
+	}
+	for k, v := range o.header {
+		req.Header[k] = v
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	// Drain the body so the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, 0, nil
+	}
+	err = fmt.Errorf("Request failed: %s", resp.Status)
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return false, 0, err
+	}
+	if seconds, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil && seconds > 0 {
+		after = time.Duration(seconds) * time.Second
+	}
+	return true, after, err
+}
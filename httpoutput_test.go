@@ -0,0 +1,448 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A request received by testHTTPServer.
+type testHTTPRequest struct {
+	header http.Header
+	body   string
+}
+
+// An httptest.Server which records each request, responding with the given
+// status codes in order and then 200. Failed requests include retryAfter as
+// their Retry-After header if it is set.
+type testHTTPServer struct {
+	*httptest.Server
+	mutex      sync.Mutex
+	requests   []testHTTPRequest
+	statuses   []int
+	retryAfter string
+}
+
+func newTestHTTPServer(statuses ...int) *testHTTPServer {
+	s := &testHTTPServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			if err == nil {
+				body, _ = ioutil.ReadAll(gz)
+			}
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.requests = append(s.requests, testHTTPRequest{r.Header, string(body)})
+		if len(s.statuses) > 0 {
+			if s.retryAfter != "" {
+				w.Header().Set("Retry-After", s.retryAfter)
+			}
+			w.WriteHeader(s.statuses[0])
+			s.statuses = s.statuses[1:]
+		}
+	}))
+	return s
+}
+
+func (s *testHTTPServer) received() []testHTTPRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]testHTTPRequest(nil), s.requests...)
+}
+
+func testHTTPLine(message string, fields map[string]interface{}) *LineData {
+	return &LineData{
+		Message:   message,
+		Class:     INFO,
+		TimeStamp: time.Unix(1, 5).UTC(),
+		Fields:    fields,
+	}
+}
+
+func TestHTTPOutputBatchLines(t *testing.T) {
+	s := newTestHTTPServer()
+	defer s.Close()
+
+	o := newTestOutput(t, newOutputFuncHTTP,
+		s.URL+"/logs?batch=2&interval=1h&key.time=&key.package=&"+
+			"key.function=&key.sourcefile=&key.sourceline=&key.fields=").(*httpOutput)
+	for _, m := range []string{"one", "two", "three"} {
+		if err := o.Write(testHTTPLine(m, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first two lines fill a batch, while Flush forces the third.
+	if got := len(s.received()); got != 1 {
+		t.Fatalf("Expected 1 request before flushing, got %d", got)
+	}
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	requests := s.received()
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(requests))
+	}
+	expected := `{"class":"info","message":"one"}` + "\n" + `{"class":"info","message":"two"}` + "\n"
+	if requests[0].body != expected {
+		t.Fatalf("Expected %q, got %q", expected, requests[0].body)
+	}
+	if requests[1].body != `{"class":"info","message":"three"}`+"\n" {
+		t.Fatalf("Unexpected body %q", requests[1].body)
+	}
+	if ct := requests[0].header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Unexpected Content-Type %q", ct)
+	}
+
+	// Flushing an empty batch sends nothing.
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	} else if got := len(s.received()); got != 2 {
+		t.Fatalf("Expected 2 requests, got %d", got)
+	}
+}
+
+func TestHTTPOutputBatchBytes(t *testing.T) {
+	s := newTestHTTPServer()
+	defer s.Close()
+
+	o := newTestOutput(t, newOutputFuncHTTP, s.URL+"?bytes=10&interval=1h").(*httpOutput)
+	o.Write(testHTTPLine("a long enough message", nil))
+	if got := len(s.received()); got != 1 {
+		t.Fatalf("Expected 1 request, got %d", got)
+	}
+}
+
+func TestHTTPOutputInterval(t *testing.T) {
+	s := newTestHTTPServer()
+	defer s.Close()
+
+	o := newTestOutput(t, newOutputFuncHTTP, s.URL+"?interval=10ms").(*httpOutput)
+	o.Write(testHTTPLine("one", nil))
+	for i := 0; i < 500 && len(s.received()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := len(s.received()); got != 1 {
+		t.Fatalf("Expected 1 request, got %d", got)
+	}
+}
+
+func TestHTTPOutputHeadersAndGzip(t *testing.T) {
+	s := newTestHTTPServer()
+	defer s.Close()
+
+	o := newTestOutput(t, newOutputFuncHTTP,
+		s.URL+"?gzip=true&header.x-api-key=secret&header.Authorization=Bearer%20abc").(*httpOutput)
+	o.Write(testHTTPLine("one", nil))
+	o.Flush()
+
+	requests := s.received()
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(requests))
+	}
+	h := requests[0].header
+	if h.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzip body.")
+	} else if h.Get("X-Api-Key") != "secret" {
+		t.Fatalf("Expected the X-Api-Key header, got %v", h)
+	} else if h.Get("Authorization") != "Bearer abc" {
+		t.Fatalf("Unexpected Authorization %q", h.Get("Authorization"))
+	}
+	if !strings.Contains(requests[0].body, `"message":"one"`) {
+		t.Fatalf("Unexpected body %q", requests[0].body)
+	}
+}
+
+func TestHTTPOutputBasicAuth(t *testing.T) {
+	s := newTestHTTPServer()
+	defer s.Close()
+
+	u, _ := url.Parse(s.URL)
+	o := newTestOutput(t, newOutputFuncHTTP, "http://user:pass@"+u.Host).(*httpOutput)
+	o.Write(testHTTPLine("one", nil))
+	o.Flush()
+
+	requests := s.received()
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(requests))
+	}
+	req := &http.Request{Header: requests[0].header}
+	if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		t.Fatalf("Expected basic authentication, got %q %q", user, pass)
+	}
+}
+
+func TestHTTPOutputRetry(t *testing.T) {
+	s := newTestHTTPServer(503, 429)
+	defer s.Close()
+
+	o := newTestOutput(t, newOutputFuncHTTP, s.URL+"?backoff=1ms").(*httpOutput)
+	o.Write(testHTTPLine("one", nil))
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	requests := s.received()
+	if len(requests) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(requests))
+	}
+	for _, r := range requests[1:] {
+		if r.body != requests[0].body {
+			t.Fatalf("Expected the same body to be retried.")
+		}
+	}
+}
+
+func TestHTTPOutputRetryLimit(t *testing.T) {
+	s := newTestHTTPServer(500, 500, 500)
+	defer s.Close()
+
+	o := newTestOutput(t, newOutputFuncHTTP, s.URL+"?backoff=1ms&retries=2").(*httpOutput)
+	o.Write(testHTTPLine("one", nil))
+	if err := o.Flush(); err == nil {
+		t.Fatalf("Expected an error.")
+	}
+	if got := len(s.received()); got != 3 {
+		t.Fatalf("Expected 3 requests, got %d", got)
+	}
+
+	// The failed batch is discarded.
+	o.Write(testHTTPLine("two", nil))
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	requests := s.received()
+	if len(requests) != 4 || strings.Contains(requests[3].body, "one") {
+		t.Fatalf("Expected the failed batch to be discarded.")
+	}
+}
+
+func TestHTTPOutputRetryAfterLimit(t *testing.T) {
+	s := newTestHTTPServer(503)
+	s.retryAfter = "3600"
+	defer s.Close()
+
+	o := newTestOutput(t, newOutputFuncHTTP, s.URL+"?backoff=1ms&maxbackoff=10ms").(*httpOutput)
+	o.Write(testHTTPLine("one", nil))
+	start := time.Now()
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the Retry-After delay to be limited, waited %s", elapsed)
+	}
+	if got := len(s.received()); got != 2 {
+		t.Fatalf("Expected 2 requests, got %d", got)
+	}
+}
+
+func TestHTTPOutputWriteWhileRetrying(t *testing.T) {
+	s := newTestHTTPServer(503)
+	defer s.Close()
+
+	o := newTestOutput(t, newOutputFuncHTTP, s.URL+"?backoff=500ms&interval=1ms").(*httpOutput)
+	o.Write(testHTTPLine("one", nil))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The batch was never sent.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The timer is waiting to retry the first batch, which must not prevent
+	// lines being added to the next one.
+	o.Write(testHTTPLine("two", nil))
+	if got := len(s.received()); got != 1 {
+		t.Fatalf("Expected Write to return before the retry, got %d requests", got)
+	}
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	requests := s.received()
+	if len(requests) != 3 || !strings.Contains(requests[1].body, "one") ||
+		!strings.Contains(requests[2].body, "two") {
+		t.Fatalf("Unexpected requests: %v", requests)
+	}
+}
+
+func TestHTTPOutputNoRetry(t *testing.T) {
+	s := newTestHTTPServer(400)
+	defer s.Close()
+
+	o := newTestOutput(t, newOutputFuncHTTP, s.URL+"?backoff=1ms").(*httpOutput)
+	o.Write(testHTTPLine("one", nil))
+	if err := o.Flush(); err == nil {
+		t.Fatalf("Expected an error.")
+	}
+	if got := len(s.received()); got != 1 {
+		t.Fatalf("Expected 1 request, got %d", got)
+	}
+}
+
+func TestHTTPOutputElasticsearch(t *testing.T) {
+	s := newTestHTTPServer()
+	defer s.Close()
+
+	o := newTestOutput(t, newOutputFuncHTTP,
+		s.URL+"/_bulk?encoder=elasticsearch&index=logs&key.package=&"+
+			"key.function=&key.sourcefile=&key.sourceline=&key.fields=").(*httpOutput)
+	o.Write(testHTTPLine("one", nil))
+	o.Write(testHTTPLine("two", nil))
+	o.Flush()
+
+	requests := s.received()
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(requests))
+	}
+	expected := `{"index":{"_index":"logs"}}` + "\n" +
+		`{"time":"1970-01-01T00:00:01.000000005Z","class":"info","message":"one"}` + "\n" +
+		`{"index":{"_index":"logs"}}` + "\n" +
+		`{"time":"1970-01-01T00:00:01.000000005Z","class":"info","message":"two"}` + "\n"
+	if requests[0].body != expected {
+		t.Fatalf("Expected %q, got %q", expected, requests[0].body)
+	}
+}
+
+func TestHTTPOutputLoki(t *testing.T) {
+	s := newTestHTTPServer()
+	defer s.Close()
+
+	o := newTestOutput(t, newOutputFuncHTTP,
+		s.URL+"/loki/api/v1/push?encoder=loki&label.job=app&labels=host,missing").(*httpOutput)
+	o.Write(testHTTPLine("one", map[string]interface{}{"host": "box"}))
+	o.Write(testHTTPLine("two", nil))
+	o.Flush()
+
+	requests := s.received()
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(requests))
+	}
+	if ct := requests[0].header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Unexpected Content-Type %q", ct)
+	}
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][]string        `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal([]byte(requests[0].body), &push); err != nil {
+		t.Fatalf("Invalid body %q: %s", requests[0].body, err)
+	}
+	if len(push.Streams) != 2 {
+		t.Fatalf("Expected 2 streams, got %d", len(push.Streams))
+	}
+	first, second := push.Streams[0], push.Streams[1]
+	if len(first.Stream) != 2 || first.Stream["job"] != "app" || first.Stream["host"] != "box" {
+		t.Fatalf("Unexpected labels %v", first.Stream)
+	} else if len(second.Stream) != 1 || second.Stream["job"] != "app" {
+		t.Fatalf("Unexpected labels %v", second.Stream)
+	}
+	if len(first.Values) != 1 || first.Values[0][0] != "1000000005" ||
+		!strings.Contains(first.Values[0][1], `"message":"one"`) {
+		t.Fatalf("Unexpected values %v", first.Values)
+	}
+}
+
+func TestHTTPOutputLokiDefaultLabels(t *testing.T) {
+	e, err := newLokiEncoder(url.Values{"labels": {"host"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	e.Encode(&b, testHTTPLine("one", map[string]interface{}{"host": "box"}))
+	e.Encode(&b, testHTTPLine("two", nil))
+	e.Finish(&b)
+
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &push); err != nil {
+		t.Fatalf("Invalid body %q: %s", b.String(), err)
+	}
+	if len(push.Streams) != 2 {
+		t.Fatalf("Expected 2 streams, got %d", len(push.Streams))
+	} else if labels := push.Streams[0].Stream; len(labels) != 1 || labels["host"] != "box" {
+		t.Fatalf("Unexpected labels %v", labels)
+	} else if labels := push.Streams[1].Stream; len(labels) != 1 || labels["job"] != "logray" {
+		t.Fatalf("Expected the default labels, got %v", labels)
+	}
+}
+
+// An encoder which writes each message on its own line.
+type testHTTPEncoder struct{}
+
+func (e testHTTPEncoder) ContentType() string { return "text/plain" }
+func (e testHTTPEncoder) Encode(b *bytes.Buffer, ld *LineData) {
+	b.WriteString(ld.Message + "\n")
+}
+func (e testHTTPEncoder) Finish(b *bytes.Buffer) { b.WriteString("end\n") }
+
+func TestHTTPOutputCustomEncoder(t *testing.T) {
+	if !AddHTTPEncoder("testplain", func(values url.Values) (HTTPEncoder, error) {
+		return testHTTPEncoder{}, nil
+	}) {
+		t.Fatalf("Expected the encoder to be added.")
+	}
+	defer func() {
+		httpEncoderMutex.Lock()
+		delete(httpEncoderMap, "testplain")
+		httpEncoderMutex.Unlock()
+	}()
+	if AddHTTPEncoder("ndjson", newNDJSONEncoder) {
+		t.Fatalf("Expected an existing encoder to be rejected.")
+	}
+
+	s := newTestHTTPServer()
+	defer s.Close()
+	o := newTestOutput(t, newOutputFuncHTTP, s.URL+"?encoder=testplain").(*httpOutput)
+	o.Write(testHTTPLine("one", nil))
+	o.Write(testHTTPLine("two", nil))
+	o.Flush()
+
+	requests := s.received()
+	if len(requests) != 1 || requests[0].body != "one\ntwo\nend\n" {
+		t.Fatalf("Unexpected requests %v", requests)
+	}
+}
+
+func TestHTTPOutputBadParams(t *testing.T) {
+	for _, uri := range []string{
+		"http:///path",
+		"http://localhost#frag",
+		"http://localhost?unknown=1",
+		"http://localhost?encoder=unknown",
+		"http://localhost?batch=0",
+		"http://localhost?bytes=x",
+		"http://localhost?retries=-1",
+		"http://localhost?interval=0s",
+		"http://localhost?gzip=maybe",
+		"http://localhost?key.unknown=x",
+		"http://localhost?encoder=loki",
+		"http://localhost?ca=ca.pem",
+		"https://localhost?ca=/does/not/exist",
+	} {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newOutputFuncHTTP(u); err == nil {
+			t.Fatalf("Expected an error for %s", uri)
+		}
+	}
+}
@@ -8,10 +8,4 @@ func init() {
 
 	// Load the default configuration.
 	lockedSetupOutputMap()
-
-	// Make sure we have a channel for transiting log data.
-	transitChannel = make(chan backgroundWorker, 1000)
-
-	// Setup the flusher goroutine.
-	go goLogger()
 }
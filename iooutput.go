@@ -80,6 +80,8 @@ type ioOutput struct {
 //        consistent width.
 //    %message% - Replaced with the message generated when logging. This is
 //        the string ultimately generated by the call to functions like Infof()
+//    %category% - Replaced with the name of the Logger that generated the
+//        line (see Named), or nothing if the Logger has no name.
 //    %nanosecond% - Replaced with the number of nanoseconds elapsed since the
 //        start of the last second in the time stamp. This will always be
 //        a 9 digit number from 000000000 to 999999999.
@@ -165,6 +167,17 @@ type ioOutput struct {
 // and such will return an error here, which in turn prevents the output from
 // being used.
 func NewIOWriterOutput(w io.Writer, format string, color string) (Output, error) {
+	o, err := newIOOutput(w, format, color)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// newIOOutput is the inner implementation of NewIOWriterOutput. It returns the
+// concrete type so that other outputs can reuse the format string handling by
+// way of the format() function.
+func newIOOutput(w io.Writer, format string, color string) (*ioOutput, error) {
 	// Set defaults for color and format if they are not currently defined.
 	if format == "" {
 		format = DefaultFormatString
@@ -224,15 +237,9 @@ func NewIOWriterOutput(w io.Writer, format string, color string) (Output, error)
 // Write attempts to add a line to this output object. This may be buffered, or
 // unbuffered so its not safe to assume that this call will not block.
 func (o *ioOutput) Write(ld *LineData) error {
-	size := o.initialSize + len(ld.Message) + 1
-	buffer := bytes.NewBuffer(make([]byte, 0, size))
-
-	// Walk the formatting functions calling them so they can write to the output
-	// buffer where possible.
-	for _, f := range o.formatFuncs {
-		if err := f(ld, buffer); err != nil {
-			return err
-		}
+	buffer, err := o.format(ld)
+	if err != nil {
+		return err
 	}
 
 	// Return the bytes that we generated in the functions above.
@@ -250,12 +257,56 @@ func (o *ioOutput) Write(ld *LineData) error {
 	return nil
 }
 
+// format renders the given line through the parsed format string and returns
+// the resulting buffer. No trailing newline is added.
+func (o *ioOutput) format(ld *LineData) (*bytes.Buffer, error) {
+	size := o.initialSize + len(ld.Message) + 1
+	buffer := bytes.NewBuffer(make([]byte, 0, size))
+
+	// Walk the formatting functions calling them so they can write to the output
+	// buffer where possible.
+	for _, f := range o.formatFuncs {
+		if err := f(ld, buffer); err != nil {
+			return nil, err
+		}
+	}
+	return buffer, nil
+}
+
 // Flushes all logs that have been buffered for writing to this output.
 func (o *ioOutput) Flush() error {
-	if w, ok := o.writer.(flushWriter); ok {
+	return flushIOWriter(o.writer)
+}
+
+// Reopens the underlying io.Writer if it supports it.
+func (o *ioOutput) Reopen() error {
+	return reopenIOWriter(o.writer)
+}
+
+// Closes the underlying io.Writer if it supports it.
+func (o *ioOutput) Close() error {
+	return closeIOWriter(o.writer)
+}
+
+// Closes the given io.Writer if it implements io.Closer. The standard streams
+// are never closed as they are shared with the rest of the process.
+func closeIOWriter(w io.Writer) error {
+	if f, ok := w.(*os.File); ok && f.Fd() <= 2 {
+		return nil
+	}
+	if c, ok := w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Flushes the given io.Writer via either its Flush() or Sync() function if it
+// has one.
+func flushIOWriter(w io.Writer) error {
+	if w, ok := w.(flushWriter); ok {
 		return w.Flush()
 	}
-	if w, ok := o.writer.(syncWriter); ok {
+	if w, ok := w.(syncWriter); ok {
 		return w.Sync()
 	}
 	return nil
@@ -427,6 +478,8 @@ func (fp *formatParser) processCode(index int) error {
 	case code == "message":
 		// len(ld.Message) already gets added into the buffer.
 		fp.addFormatFunc(ioOutputFormatMessage, 0)
+	case code == "category":
+		fp.addFormatFunc(ioOutputFormatCategory, 0)
 
 		// Time format functions.
 	case code == "nanosecond":
@@ -533,6 +586,12 @@ func ioOutputFormatMessage(ld *LineData, b *bytes.Buffer) error {
 	return err
 }
 
+// Formatting function used to implement the %category% code.
+func ioOutputFormatCategory(ld *LineData, b *bytes.Buffer) error {
+	_, err := b.WriteString(ld.Name)
+	return err
+}
+
 // Formatting function used to implement the %nanosecond% code.
 func ioOutputFormatNanoSecond(ld *LineData, b *bytes.Buffer) error {
 	_, err := b.WriteString(fmt.Sprintf("%09d", ld.TimeStamp.Nanosecond()))
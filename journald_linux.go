@@ -0,0 +1,358 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The socket used by journald's native protocol.
+const journaldDefaultSocket = "/run/systemd/journal/socket"
+
+// The send buffer size requested for the socket, which matches the size used
+// by systemd's own clients so that most entries fit in a single datagram.
+const journaldSendBuffer = 8 * 1024 * 1024
+
+// Flags and seals used when passing an entry to journald in a memfd, which
+// journald requires to be sealed.
+const (
+	journaldMFDCloexec       = 0x1
+	journaldMFDAllowSealing  = 0x2
+	journaldFAddSeals        = 1033
+	journaldSeals            = 0x1 | 0x2 | 0x4 | 0x8 // seal, shrink, grow, write
+	journaldSharedMemoryPath = "/dev/shm"
+)
+
+// The memfd_create system call number for each architecture, as it is not
+// defined by the syscall package on all of them. When it is not known, or
+// the kernel does not support it, an unlinked file in /dev/shm is used
+// instead, as journald accepts either.
+var journaldMemfdCreateTrap = map[string]uintptr{
+	"386":      356,
+	"amd64":    319,
+	"arm":      385,
+	"arm64":    279,
+	"loong64":  279,
+	"mips":     4354,
+	"mipsle":   4354,
+	"mips64":   5314,
+	"mips64le": 5314,
+	"ppc64":    360,
+	"ppc64le":  360,
+	"riscv64":  279,
+	"s390x":    350,
+}
+
+// An implementation of Output which writes log lines to the systemd journal
+// using journald's native protocol.
+type journaldOutput struct {
+	// The path of journald's socket.
+	path string
+
+	// The value of SYSLOG_IDENTIFIER for each entry.
+	identifier string
+
+	// Used to render the MESSAGE of each entry.
+	formatter *ioOutput
+
+	// The current connection, or nil if not connected.
+	conn *net.UnixConn
+}
+
+// Parses a URL that starts with journald://
+//
+// Entries are sent to journald's socket at /run/systemd/journal/socket, or to
+// the socket given as the path, for example journald:///run/journal.sock.
+// Each entry has the following fields:
+//
+//	MESSAGE - The formatted line.
+//	PRIORITY - The syslog severity of the line's class.
+//	CODE_FILE, CODE_LINE, CODE_FUNC - The source of the line.
+//	SYSLOG_IDENTIFIER - The identifier given by the app parameter.
+//	LOGGER - The name of the Logger, if it has one.
+//
+// along with each member of Fields, whose names are converted to upper case
+// with any characters which are not allowed in journal field names replaced
+// by '_'. Fields which collide with one of the names above are prefixed with
+// "FIELDS_". Entries which are too large for a single datagram are passed to
+// journald in a sealed memfd. The query may contain the following parameters:
+//
+//	app - The SYSLOG_IDENTIFIER. Defaults to the name of the running binary.
+//	format - A format string for the MESSAGE. See NewIOWriterOutput.
+//	    Defaults to "%message%".
+func newOutputFuncJournald(u *url.URL) (Output, error) {
+	if u.User != nil {
+		return nil, fmt.Errorf("Can not use a username with journald.")
+	}
+	if u.Fragment != "" {
+		return nil, fmt.Errorf("Can not use a fragment with journald.")
+	}
+	if u.Host != "" {
+		return nil, fmt.Errorf("Can not use a hostname with journald.")
+	}
+
+	// Parse the RawQuery so we can extract the parameters.
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the values we need for setting up the Output object.
+	app := values.Get("app")
+	delete(values, "app")
+	format := values.Get("format")
+	delete(values, "format")
+
+	// Check that nothing else was defined.
+	if len(values) != 0 {
+		bad := make([]string, 0, len(values))
+		for k, _ := range values {
+			bad = append(bad, k)
+		}
+		return nil, fmt.Errorf("Unknown parameters: %s", strings.Join(bad, ","))
+	}
+
+	o := &journaldOutput{path: journaldDefaultSocket}
+	if u.Path != "" && u.Path != "/" {
+		o.path = uriPathToFilename(u.Path)
+	}
+
+	if app == "" {
+		app = filepath.Base(os.Args[0])
+	}
+	o.identifier = app
+
+	if format == "" {
+		format = "%message%"
+	}
+	if o.formatter, err = newIOOutput(nil, format, "off"); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// Writes a single entry to journald. If writing fails the connection will be
+// re-established and the write retried once.
+func (o *journaldOutput) Write(ld *LineData) error {
+	msg, err := o.formatter.format(ld)
+	if err != nil {
+		return err
+	}
+	entry := o.entry(ld, msg.String())
+
+	for attempt := 0; ; attempt++ {
+		if o.conn == nil {
+			if err := o.connect(); err != nil {
+				return err
+			}
+		}
+		err := o.send(entry)
+		if err == nil || attempt > 0 {
+			return err
+		}
+		o.conn.Close()
+		o.conn = nil
+	}
+}
+
+// Journal entries are unbuffered so there is nothing to flush.
+func (o *journaldOutput) Flush() error {
+	return nil
+}
+
+// Closes the connection to journald.
+func (o *journaldOutput) Close() error {
+	if o.conn == nil {
+		return nil
+	}
+	err := o.conn.Close()
+	o.conn = nil
+	return err
+}
+
+// Establishes a connection to journald's socket.
+func (o *journaldOutput) connect() error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: o.path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	// This is only a request; the kernel may limit the size.
+	conn.SetWriteBuffer(journaldSendBuffer)
+	o.conn = conn
+	return nil
+}
+
+// Sends an entry as a single datagram, or in a memfd if it is too large.
+func (o *journaldOutput) send(entry []byte) error {
+	_, err := o.conn.Write(entry)
+	if !journaldTooLarge(err) {
+		return err
+	}
+
+	f, err := journaldSharedFile(entry)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// WriteMsgUnix refuses connected datagram sockets, so the descriptor is
+	// sent with sendmsg directly.
+	rc, err := o.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	rights := syscall.UnixRights(int(f.Fd()))
+	var sendErr error
+	err = rc.Write(func(fd uintptr) bool {
+		sendErr = syscall.Sendmsg(int(fd), nil, rights, nil, 0)
+		return sendErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// Generates the native protocol encoding of an entry.
+func (o *journaldOutput) entry(ld *LineData, msg string) []byte {
+	b := bytes.NewBuffer(make([]byte, 0, 256+len(msg)))
+	used := make(map[string]bool, 8)
+	field := func(name, value string) {
+		used[name] = true
+		journaldField(b, name, value)
+	}
+
+	field("MESSAGE", msg)
+	field("PRIORITY", strconv.Itoa(syslogSeverity(ld.Class)))
+	field("SYSLOG_IDENTIFIER", o.identifier)
+	if ld.SourceFile != "" {
+		field("CODE_FILE", ld.SourceFile)
+		field("CODE_LINE", strconv.Itoa(ld.SourceLine))
+	}
+	if ld.CallingFunction != "" {
+		field("CODE_FUNC", ld.CallingFunction)
+	}
+	if ld.Name != "" {
+		field("LOGGER", ld.Name)
+	}
+
+	for _, k := range sortedFieldKeys(ld.Fields) {
+		name := journaldFieldName(k)
+		if name == "" {
+			continue
+		} else if used[name] {
+			name = journaldFieldName("FIELDS_" + name)
+		}
+		field(name, fmt.Sprint(ld.Fields[k]))
+	}
+	return b.Bytes()
+}
+
+// Writes a single field. Values containing a newline are written with their
+// length as a little endian 64 bit integer, which allows any content.
+func journaldField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if strings.IndexByte(value, '\n') < 0 {
+		b.WriteByte('=')
+	} else {
+		b.WriteByte('\n')
+		var size [8]byte
+		binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+		b.Write(size[:])
+	}
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// Converts a field name to a valid journal field name, which is made of upper
+// case letters, digits and underscores, does not start with an underscore or
+// a digit, and is at most 64 characters long. An empty string is returned if
+// nothing remains of the name.
+func journaldFieldName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, name)
+	name = strings.TrimLeft(name, "_0123456789")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// Returns true if a write failed because the datagram was too large.
+func journaldTooLarge(err error) bool {
+	if err == nil {
+		return false
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.EMSGSIZE || err == syscall.ENOBUFS
+}
+
+// Returns a file containing the given data which can be passed to journald,
+// preferring a sealed memfd.
+func journaldSharedFile(data []byte) (*os.File, error) {
+	if f, err := journaldMemfd(data); err == nil {
+		return f, nil
+	}
+
+	// Fall back to an unlinked file in shared memory.
+	f, err := ioutil.TempFile(journaldSharedMemoryPath, "logray-journal.")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Returns a sealed memfd containing the given data.
+func journaldMemfd(data []byte) (*os.File, error) {
+	trap, ok := journaldMemfdCreateTrap[runtime.GOARCH]
+	if !ok {
+		return nil, syscall.ENOSYS
+	}
+	name := []byte("logray-journal\x00")
+	fd, _, errno := syscall.Syscall(trap, uintptr(unsafe.Pointer(&name[0])),
+		journaldMFDCloexec|journaldMFDAllowSealing, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	f := os.NewFile(fd, "logray-journal")
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, journaldFAddSeals, journaldSeals)
+	if errno != 0 {
+		f.Close()
+		return nil, errno
+	}
+	return f, nil
+}
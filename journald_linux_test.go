@@ -0,0 +1,214 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Listens on a unixgram socket in a temporary directory, returning the
+// listener and a function which removes it.
+func newTestJournalSocket(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "logray")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skip(err)
+	}
+	return conn, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// Reads a single entry, either from the datagram or from a passed file, and
+// decodes its fields.
+func readJournalEntry(t *testing.T, conn *net.UnixConn) map[string]string {
+	buf := make([]byte, 1024*1024)
+	oob := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf[:n]
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds, err := syscall.ParseUnixRights(&msgs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := os.NewFile(uintptr(fds[0]), "entry")
+		defer f.Close()
+		f.Seek(0, 0)
+		if data, err = ioutil.ReadAll(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return parseJournalEntry(t, data)
+}
+
+func parseJournalEntry(t *testing.T, data []byte) map[string]string {
+	fields := make(map[string]string)
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "=\n")
+		if i < 0 {
+			t.Fatalf("Invalid entry %q", data)
+		}
+		name := string(data[:i])
+		if data[i] == '=' {
+			end := bytes.IndexByte(data, '\n')
+			fields[name] = string(data[i+1 : end])
+			data = data[end+1:]
+			continue
+		}
+		size := int(binary.LittleEndian.Uint64(data[i+1 : i+9]))
+		fields[name] = string(data[i+9 : i+9+size])
+		if data[i+9+size] != '\n' {
+			t.Fatalf("Expected a newline after %s", name)
+		}
+		data = data[i+10+size:]
+	}
+	return fields
+}
+
+func TestJournaldEntry(t *testing.T) {
+	conn, cleanup := newTestJournalSocket(t)
+	defer cleanup()
+
+	o := newTestOutput(t, newOutputFuncJournald,
+		"journald://"+conn.LocalAddr().String()+"?app=myapp").(*journaldOutput)
+	defer o.Close()
+	ld := &LineData{
+		Message:         "failed",
+		Class:           ERROR,
+		SourceFile:      "main.go",
+		SourceLine:      12,
+		CallingFunction: "main",
+		Name:            "db",
+		Fields: map[string]interface{}{
+			"stack":      "\n\tmain.go:12 main",
+			"user-id":    7,
+			"_private":   "x",
+			"message":    "dup",
+			"2fa.method": "otp",
+		},
+	}
+	if err := o.Write(ld); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"MESSAGE":           "failed",
+		"PRIORITY":          "3",
+		"SYSLOG_IDENTIFIER": "myapp",
+		"CODE_FILE":         "main.go",
+		"CODE_LINE":         "12",
+		"CODE_FUNC":         "main",
+		"LOGGER":            "db",
+		"STACK":             "\n\tmain.go:12 main",
+		"USER_ID":           "7",
+		"PRIVATE":           "x",
+		"FIELDS_MESSAGE":    "dup",
+		"FA_METHOD":         "otp",
+	}
+	fields := readJournalEntry(t, conn)
+	if len(fields) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, fields)
+	}
+	for k, v := range expected {
+		if fields[k] != v {
+			t.Fatalf("Expected %s to be %q, got %q", k, v, fields[k])
+		}
+	}
+}
+
+func TestJournaldLargeEntry(t *testing.T) {
+	conn, cleanup := newTestJournalSocket(t)
+	defer cleanup()
+
+	// Larger than the maximum datagram size allowed by the kernel.
+	message := strings.Repeat("x", 16*1024*1024)
+	o := newTestOutput(t, newOutputFuncJournald,
+		"journald://"+conn.LocalAddr().String()).(*journaldOutput)
+	defer o.Close()
+	if err := o.Write(&LineData{Message: message, Class: INFO}); err != nil {
+		t.Fatal(err)
+	}
+	fields := readJournalEntry(t, conn)
+	if fields["MESSAGE"] != message || fields["PRIORITY"] != "6" {
+		t.Fatalf("Expected the entry to be passed in a file.")
+	}
+}
+
+func TestJournaldMemfd(t *testing.T) {
+	f, err := journaldMemfd([]byte("MESSAGE=hello\n"))
+	if err == syscall.ENOSYS {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The memfd is sealed, so it can no longer be written to.
+	if _, err := f.Write([]byte("more")); err == nil {
+		t.Fatalf("Expected the memfd to be sealed.")
+	}
+	data := make([]byte, 14)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "MESSAGE=hello\n" {
+		t.Fatalf("Unexpected contents %q", data)
+	}
+}
+
+func TestJournaldFieldName(t *testing.T) {
+	tests := map[string]string{
+		"user":                  "USER",
+		"Request.ID":            "REQUEST_ID",
+		"__x":                   "X",
+		"9lives":                "LIVES",
+		"___":                   "",
+		strings.Repeat("a", 70): strings.Repeat("A", 64),
+		"café":                  "CAF_",
+	}
+	for name, expected := range tests {
+		if got := journaldFieldName(name); got != expected {
+			t.Fatalf("Expected %q for %q, got %q", expected, name, got)
+		}
+	}
+}
+
+func TestJournaldBadParams(t *testing.T) {
+	for _, uri := range []string{
+		"journald://localhost",
+		"journald://user@/path",
+		"journald://#frag",
+		"journald://?unknown=1",
+	} {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newOutputFuncJournald(u); err == nil {
+			t.Fatalf("Expected an error for %s", uri)
+		}
+	}
+}
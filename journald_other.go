@@ -0,0 +1,16 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+//go:build !linux
+// +build !linux
+
+package logray
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// The journal is only available on Linux.
+func newOutputFuncJournald(u *url.URL) (Output, error) {
+	return nil, fmt.Errorf("journald is only supported on Linux.")
+}
@@ -0,0 +1,236 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// FieldKeys defines the names used for each element of a LineData when it is
+// written by one of the structured outputs. Setting a key to an empty string
+// omits that element from the output, with the exception of Fields in JSON
+// output where an empty key places each field at the top level of the object.
+type FieldKeys struct {
+	Time       string
+	Class      string
+	Message    string
+	Package    string
+	Function   string
+	SourceFile string
+	SourceLine string
+	Caller     string
+	Name       string
+	Fields     string
+}
+
+var (
+	// The default keys used by JSON outputs. These match the json tags on
+	// LineData.
+	DefaultJSONKeys = FieldKeys{
+		Time:       "time",
+		Class:      "class",
+		Message:    "message",
+		Package:    "calling_package",
+		Function:   "calling_function",
+		SourceFile: "source_file",
+		SourceLine: "source_line",
+		Name:       "name",
+		Fields:     "fields",
+	}
+)
+
+// Sets the key for the element with the given name. Names are the lowercase
+// form of the FieldKeys members.
+func (k *FieldKeys) set(name, key string) error {
+	switch name {
+	case "time":
+		k.Time = key
+	case "class":
+		k.Class = key
+	case "message":
+		k.Message = key
+	case "package":
+		k.Package = key
+	case "function":
+		k.Function = key
+	case "sourcefile":
+		k.SourceFile = key
+	case "sourceline":
+		k.SourceLine = key
+	case "caller":
+		k.Caller = key
+	case "name":
+		k.Name = key
+	case "fields":
+		k.Fields = key
+	default:
+		return fmt.Errorf("Unknown key name: %s", name)
+	}
+	return nil
+}
+
+// An implementation of Output that writes each line as a single JSON object
+// followed by a newline.
+type jsonOutput struct {
+	// The keys used for each element of the line.
+	keys FieldKeys
+
+	// The io.Writer that log data will be written too.
+	writer io.Writer
+}
+
+// NewJSONOutput creates an Output that writes each LineData to the given
+// io.Writer as a JSON object on a single line, using the given keys. Fields are
+// sorted by name. Field values which can not be marshaled are written as a
+// string generated by fmt rather than causing the line to be dropped, and values
+// implementing error are written as the result of their Error() function.
+//
+// This is used by the io.Writer backed schemes when the "format" parameter is
+// set to "json", in which case key names can be overridden with parameters of
+// the form key.<name>=<key>, for example:
+//
+//	stdout://?format=json&key.message=msg&key.fields=
+func NewJSONOutput(w io.Writer, keys FieldKeys) (Output, error) {
+	return &jsonOutput{keys: keys, writer: w}, nil
+}
+
+// Writes a single line to the io.Writer.
+func (o *jsonOutput) Write(ld *LineData) error {
+	buffer := bytes.NewBuffer(make([]byte, 0, 256+len(ld.Message)))
+	o.format(ld, buffer)
+	buffer.WriteByte('\n')
+	_, err := o.writer.Write(buffer.Bytes())
+	return err
+}
+
+// Flushes the underlying io.Writer if it supports it.
+func (o *jsonOutput) Flush() error {
+	return flushIOWriter(o.writer)
+}
+
+// Reopens the underlying io.Writer if it supports it.
+func (o *jsonOutput) Reopen() error {
+	return reopenIOWriter(o.writer)
+}
+
+// Closes the underlying io.Writer if it supports it.
+func (o *jsonOutput) Close() error {
+	return closeIOWriter(o.writer)
+}
+
+// Renders the JSON object for the given line into the buffer.
+func (o *jsonOutput) format(ld *LineData, b *bytes.Buffer) {
+	first := true
+	used := make(map[string]bool, 8)
+	member := func(key string, value []byte) {
+		if key == "" {
+			return
+		}
+		if first {
+			b.WriteByte('{')
+			first = false
+		} else {
+			b.WriteByte(',')
+		}
+		used[key] = true
+		b.Write(jsonValue(key))
+		b.WriteByte(':')
+		b.Write(value)
+	}
+
+	member(o.keys.Time, jsonValue(ld.TimeStamp.Format(time.RFC3339Nano)))
+	member(o.keys.Class, jsonValue(ld.Class.String()))
+	member(o.keys.Message, jsonValue(ld.Message))
+	member(o.keys.Package, jsonValue(ld.CallingPackage))
+	member(o.keys.Function, jsonValue(ld.CallingFunction))
+	member(o.keys.SourceFile, jsonValue(ld.SourceFile))
+	if o.keys.SourceLine != "" {
+		member(o.keys.SourceLine, jsonValue(ld.SourceLine))
+	}
+	if o.keys.Caller != "" {
+		member(o.keys.Caller, jsonValue(caller(ld)))
+	}
+	if ld.Name != "" {
+		member(o.keys.Name, jsonValue(ld.Name))
+	}
+
+	keys := sortedFieldKeys(ld.Fields)
+	if o.keys.Fields != "" {
+		fields := bytes.NewBuffer(make([]byte, 0, 32*len(keys)))
+		fields.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				fields.WriteByte(',')
+			}
+			fields.Write(jsonValue(k))
+			fields.WriteByte(':')
+			fields.Write(jsonValue(ld.Fields[k]))
+		}
+		fields.WriteByte('}')
+		member(o.keys.Fields, fields.Bytes())
+	} else {
+		// Fields are written at the top level. Fields that collide with one of
+		// the keys above are prefixed so they are not lost.
+		for _, k := range keys {
+			key := k
+			if used[key] {
+				key = "fields." + k
+			}
+			member(key, jsonValue(ld.Fields[k]))
+		}
+	}
+
+	if first {
+		b.WriteByte('{')
+	}
+	b.WriteByte('}')
+}
+
+// Returns the source of the line in the form file:line, or an empty string if
+// the source is not known.
+func caller(ld *LineData) string {
+	if ld.SourceFile == "" {
+		return ""
+	}
+	return ld.SourceFile + ":" + strconv.Itoa(ld.SourceLine)
+}
+
+// Returns the names of all fields in sorted order.
+func sortedFieldKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Marshals a single value to JSON. This never fails; values that can not be
+// marshaled (or which panic while doing so) are converted to a string instead.
+func jsonValue(v interface{}) (data []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			data, _ = json.Marshal(fmt.Sprintf("%%!v(PANIC=%v)", r))
+		}
+	}()
+
+	// Errors rarely have exported fields so they would otherwise be written
+	// as {}.
+	if err, ok := v.(error); ok {
+		if _, ok := v.(json.Marshaler); !ok {
+			v = err.Error()
+		}
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprintf("%+v", v))
+	}
+	return data
+}
@@ -0,0 +1,139 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestJSONOutput(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	o, err := NewJSONOutput(buffer, DefaultJSONKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ld := &LineData{
+		Message:         "hello \"world\"",
+		Class:           INFO,
+		TimeStamp:       time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+		CallingPackage:  "github.com/apcera/logray",
+		CallingFunction: "TestJSONOutput",
+		SourceFile:      "jsonoutput_test.go",
+		SourceLine:      10,
+		Name:            "db.pool",
+		Fields: map[string]interface{}{
+			"str":  "a\nb",
+			"err":  errors.New("boom"),
+			"nan":  math.NaN(),
+			"chan": make(chan int),
+		},
+	}
+	if err := o.Write(ld); err != nil {
+		t.Fatal(err)
+	}
+
+	line := buffer.String()
+	if line[len(line)-1] != '\n' {
+		t.Fatalf("Expected a trailing newline: %q", line)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", line, err)
+	}
+	if decoded["message"] != ld.Message {
+		t.Fatalf("Unexpected message: %v", decoded["message"])
+	}
+	if decoded["class"] != "info" {
+		t.Fatalf("Unexpected class: %v", decoded["class"])
+	}
+	if decoded["time"] != "2014-01-02T03:04:05Z" {
+		t.Fatalf("Unexpected time: %v", decoded["time"])
+	}
+	if decoded["name"] != "db.pool" {
+		t.Fatalf("Unexpected name: %v", decoded["name"])
+	}
+	if decoded["source_line"] != float64(10) {
+		t.Fatalf("Unexpected source line: %v", decoded["source_line"])
+	}
+	fields := decoded["fields"].(map[string]interface{})
+	if fields["str"] != "a\nb" || fields["err"] != "boom" || fields["nan"] != "NaN" {
+		t.Fatalf("Unexpected fields: %v", fields)
+	}
+	if _, ok := fields["chan"].(string); !ok {
+		t.Fatalf("Expected unmarshalable value to be a string: %v", fields["chan"])
+	}
+}
+
+func TestJSONOutputKeys(t *testing.T) {
+	u, err := url.Parse("stdout://?format=json&key.message=msg&key.fields=&key.package=&key.function=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options, err := parseIOOutputOptions(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Fatalf("Unused parameters: %v", values)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	o, err := options.newOutput(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ld := &LineData{
+		Message: "m",
+		Class:   ERROR,
+		Fields:  map[string]interface{}{"msg": "collides", "k": 1},
+	}
+	if err := o.Write(ld); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", buffer.String(), err)
+	}
+	expected := map[string]interface{}{
+		"time":        "0001-01-01T00:00:00Z",
+		"class":       "error",
+		"msg":         "m",
+		"source_file": "",
+		"source_line": float64(0),
+		"k":           float64(1),
+		"fields.msg":  "collides",
+	}
+	if len(decoded) != len(expected) {
+		t.Fatalf("Unexpected object: %v", decoded)
+	}
+	for k, v := range expected {
+		if decoded[k] != v {
+			t.Fatalf("Unexpected value for %s: %v", k, decoded[k])
+		}
+	}
+}
+
+func TestJSONOutputBadKeys(t *testing.T) {
+	for _, query := range []string{"format=json&key.bogus=x", "key.message=x"} {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseIOOutputOptions(values); err == nil {
+			t.Fatalf("Expected an error for %s", query)
+		}
+	}
+}
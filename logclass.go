@@ -55,40 +55,129 @@ func (l LogClass) String() string {
 }
 
 // Parses a logclass string into a LogClass object. This call is case
-// insensitive. If the string is not recognised then an error will be returned
-// and LogClass will be set to NONE.
+// insensitive. The string is a list of terms separated by '|' or ',', where
+// each term is one of:
+//
+//	a class name such as "debug", or "all" or "none"
+//	a class name followed by '+', such as "info+", for that class and above
+//	a comparison such as ">=info", ">info", "<=warn" or "<warn"
+//	any of the above prefixed with '-' to remove those classes
+//
+// Terms are applied in order, so "all,-trace" is every class except TRACE. If
+// the first term removes classes then it removes them from ALL, so "-trace" is
+// the same as "all,-trace". Every string generated by String() can be parsed
+// back into the same LogClass. If the string is not recognised then an error
+// will be returned and LogClass will be set to NONE.
 func ParseLogClass(s string) (LogClass, error) {
-	switch strings.ToLower(s) {
+	terms := strings.FieldsFunc(s, func(r rune) bool { return r == '|' || r == ',' })
+	if len(terms) == 0 {
+		return NONE, fmt.Errorf("Invalid LogClass string: %s", s)
+	}
+
+	class := NONE
+	for i, term := range terms {
+		term = strings.ToLower(strings.TrimSpace(term))
+		remove := strings.HasPrefix(term, "-")
+		if remove {
+			term = strings.TrimSpace(term[1:])
+		}
+		c, ok := parseLogClassTerm(term)
+		if !ok {
+			return NONE, fmt.Errorf("Invalid LogClass string: %s", s)
+		}
+		switch {
+		case !remove:
+			class |= c
+		case i == 0:
+			class = ALL &^ c
+		default:
+			class &^= c
+		}
+	}
+
+	// The plus marker is only kept when the result is one of the plus classes,
+	// as otherwise String() could not represent it.
+	switch class {
+	case TRACEPLUS, DEBUGPLUS, INFOPLUS, WARNPLUS, ERRORPLUS, FATALPLUS:
+		return class, nil
+	}
+	return class &^ isPLUSDEF, nil
+}
+
+// Parses a single term of a logclass string, which must already be lower case.
+func parseLogClassTerm(term string) (LogClass, bool) {
+	switch term {
 	case "none":
-		return NONE, nil
-	case "trace":
-		return TRACE, nil
-	case "trace+":
-		return TRACEPLUS, nil
-	case "debug":
-		return DEBUG, nil
-	case "debug+":
-		return DEBUGPLUS, nil
-	case "info":
-		return INFO, nil
-	case "info+":
-		return INFOPLUS, nil
-	case "warn":
-		return WARN, nil
-	case "warn+":
-		return WARNPLUS, nil
-	case "error":
-		return ERROR, nil
-	case "error+":
-		return ERRORPLUS, nil
-	case "fatal":
-		return FATAL, nil
-	case "fatal+":
-		return FATALPLUS, nil
+		return NONE, true
 	case "all":
-		return ALL, nil
+		return ALL, true
+	}
+
+	// Find the index of the base class, along with the range relative to it.
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<"} {
+		if strings.HasPrefix(term, prefix) {
+			op = prefix
+			term = strings.TrimSpace(term[len(prefix):])
+			break
+		}
+	}
+	if op == "" && strings.HasSuffix(term, "+") {
+		op = ">="
+		term = term[:len(term)-1]
 	}
-	return NONE, fmt.Errorf("Invalid LogClass string.")
+	index := -1
+	for i, c := range baseLogClasses {
+		if c.String() == term {
+			index = i
+		}
+	}
+	if index < 0 {
+		return NONE, false
+	}
+
+	var from, to int
+	switch op {
+	case "":
+		return baseLogClasses[index], true
+	case ">=":
+		from, to = index, len(baseLogClasses)
+	case ">":
+		from, to = index+1, len(baseLogClasses)
+	case "<=":
+		from, to = 0, index+1
+	case "<":
+		from, to = 0, index
+	}
+	class := NONE
+	for _, c := range baseLogClasses[from:to] {
+		class |= c
+	}
+	if to == len(baseLogClasses) && class != NONE {
+		class |= isPLUSDEF
+	}
+	return class, true
+}
+
+// Implements encoding.TextMarshaler using String().
+func (l LogClass) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Implements encoding.TextUnmarshaler using ParseLogClass.
+func (l *LogClass) UnmarshalText(text []byte) error {
+	class, err := ParseLogClass(string(text))
+	if err != nil {
+		return err
+	}
+	*l = class
+	return nil
+}
+
+// Set implements flag.Value using ParseLogClass, which allows a LogClass to be
+// used with flag.Var.
+func (l *LogClass) Set(s string) error {
+	return l.UnmarshalText([]byte(s))
 }
 
 // Returns true if the LogClass object is valid.
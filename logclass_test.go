@@ -0,0 +1,89 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"encoding/json"
+	"flag"
+	"testing"
+)
+
+func TestParseLogClass(t *testing.T) {
+	for s, expected := range map[string]LogClass{
+		"none":             NONE,
+		"ALL":              ALL,
+		"info":             INFO,
+		"Info+":            INFOPLUS,
+		"debug|error":      DEBUG | ERROR,
+		"debug, error":     DEBUG | ERROR,
+		"all,-trace":       DEBUG | INFO | WARN | ERROR | FATAL,
+		"-trace|-fatal":    DEBUG | INFO | WARN | ERROR,
+		"debug+,-error":    DEBUG | INFO | WARN | FATAL,
+		"info+|debug":      DEBUGPLUS,
+		">=info":           INFOPLUS,
+		">info":            WARNPLUS,
+		"<warn":            TRACE | DEBUG | INFO,
+		"<=warn":           TRACE | DEBUG | INFO | WARN,
+		">fatal":           NONE,
+		"<= debug, -trace": DEBUG,
+	} {
+		class, err := ParseLogClass(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %s", s, err)
+		}
+		if class != expected {
+			t.Fatalf("Expected %q to parse as %s, got %s", s, expected, class)
+		}
+	}
+
+	for _, s := range []string{"", "bogus", "info,bogus", "-", ">=all", "info++"} {
+		if _, err := ParseLogClass(s); err == nil {
+			t.Fatalf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestLogClassRoundTrip(t *testing.T) {
+	classes := []LogClass{NONE, ALL, TRACEPLUS, WARNPLUS, FATALPLUS}
+	for i := LogClass(0); i <= ALL; i++ {
+		classes = append(classes, i)
+	}
+	for _, class := range classes {
+		parsed, err := ParseLogClass(class.String())
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %s", class, err)
+		}
+		if parsed != class {
+			t.Fatalf("Expected %q to parse as %d, got %d", class, class, parsed)
+		}
+	}
+}
+
+func TestLogClassEncoding(t *testing.T) {
+	var config struct {
+		Class LogClass `json:"class"`
+	}
+	if err := json.Unmarshal([]byte(`{"class": "debug|error"}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Class != DEBUG|ERROR {
+		t.Fatalf("Unexpected class: %s", config.Class)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"class":"debug|error"}` {
+		t.Fatalf("Unexpected JSON: %s", data)
+	}
+
+	class := INFOPLUS
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Var(&class, "class", "")
+	if err := flags.Parse([]string{"-class", ">=warn"}); err != nil {
+		t.Fatal(err)
+	}
+	if class != WARNPLUS {
+		t.Fatalf("Unexpected class: %s", class)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// The default keys used by logfmt outputs.
+	DefaultLogfmtKeys = FieldKeys{
+		Time:    "time",
+		Class:   "level",
+		Message: "msg",
+		Caller:  "caller",
+		Name:    "logger",
+	}
+)
+
+// An implementation of Output that writes each line as a series of logfmt
+// key=value pairs followed by a newline.
+type logfmtOutput struct {
+	// The keys used for each element of the line.
+	keys FieldKeys
+
+	// The io.Writer that log data will be written too.
+	writer io.Writer
+}
+
+// NewLogfmtOutput creates an Output that writes each LineData to the given
+// io.Writer in logfmt. The configured time, class, message, name and caller
+// elements are written first, followed by every field sorted by name. If
+// keys.Fields is not empty it is used as a prefix for field names, separated by
+// a '.'. Values are quoted when they contain spaces, quotes, '=' or non
+// printable characters.
+//
+// This is used by the io.Writer backed schemes when the "format" parameter is
+// set to "logfmt". Key names can be overridden in the same way as for
+// NewJSONOutput.
+func NewLogfmtOutput(w io.Writer, keys FieldKeys) (Output, error) {
+	return &logfmtOutput{keys: keys, writer: w}, nil
+}
+
+// Writes a single line to the io.Writer.
+func (o *logfmtOutput) Write(ld *LineData) error {
+	buffer := bytes.NewBuffer(make([]byte, 0, 128+len(ld.Message)))
+	o.format(ld, buffer)
+	buffer.WriteByte('\n')
+	_, err := o.writer.Write(buffer.Bytes())
+	return err
+}
+
+// Flushes the underlying io.Writer if it supports it.
+func (o *logfmtOutput) Flush() error {
+	return flushIOWriter(o.writer)
+}
+
+// Reopens the underlying io.Writer if it supports it.
+func (o *logfmtOutput) Reopen() error {
+	return reopenIOWriter(o.writer)
+}
+
+// Closes the underlying io.Writer if it supports it.
+func (o *logfmtOutput) Close() error {
+	return closeIOWriter(o.writer)
+}
+
+// Renders the logfmt pairs for the given line into the buffer.
+func (o *logfmtOutput) format(ld *LineData, b *bytes.Buffer) {
+	used := make(map[string]bool, 8)
+	pair := func(key, value string) {
+		if key == "" {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		used[key] = true
+		logfmtKey(b, key)
+		b.WriteByte('=')
+		logfmtValue(b, value)
+	}
+
+	pair(o.keys.Time, ld.TimeStamp.Format(time.RFC3339Nano))
+	pair(o.keys.Class, ld.Class.String())
+	pair(o.keys.Message, ld.Message)
+	if ld.Name != "" {
+		pair(o.keys.Name, ld.Name)
+	}
+	if c := caller(ld); c != "" {
+		pair(o.keys.Caller, c)
+	}
+	pair(o.keys.Package, ld.CallingPackage)
+	pair(o.keys.Function, ld.CallingFunction)
+	pair(o.keys.SourceFile, ld.SourceFile)
+	if o.keys.SourceLine != "" {
+		pair(o.keys.SourceLine, fmt.Sprint(ld.SourceLine))
+	}
+
+	for _, k := range sortedFieldKeys(ld.Fields) {
+		key := k
+		if o.keys.Fields != "" {
+			key = o.keys.Fields + "." + k
+		} else if used[key] {
+			key = "fields." + k
+		}
+		pair(key, logfmtString(ld.Fields[k]))
+	}
+}
+
+// Converts a field value into the string that will be written. Errors are
+// formatted by fmt as well, which reports a panic in the Error method, such as
+// one called on a nil pointer, rather than letting it stop the output.
+func logfmtString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	}
+	return fmt.Sprint(v)
+}
+
+// Writes a key, replacing any characters which are not valid in a logfmt key
+// with underscores.
+func logfmtKey(b *bytes.Buffer, key string) {
+	for _, r := range key {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError {
+			r = '_'
+		}
+		b.WriteRune(r)
+	}
+}
+
+// Writes a value, quoting it if necessary.
+func logfmtValue(b *bytes.Buffer, value string) {
+	if !logfmtNeedsQuotes(value) {
+		b.WriteString(value)
+		return
+	}
+
+	b.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < ' ' || r == 0x7f {
+				fmt.Fprintf(b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+// Returns true if the value must be quoted.
+func logfmtNeedsQuotes(value string) bool {
+	if value == "" {
+		return true
+	}
+	for _, r := range value {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || r == 0x7f || r == utf8.RuneError {
+			return true
+		}
+	}
+	return false
+}
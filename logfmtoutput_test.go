@@ -0,0 +1,65 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLogfmtOutput(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	o, err := NewLogfmtOutput(buffer, DefaultLogfmtKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ld := &LineData{
+		Message:    `say "hi"`,
+		Class:      WARN,
+		TimeStamp:  time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+		SourceFile: "logfmtoutput_test.go",
+		SourceLine: 12,
+		Fields: map[string]interface{}{
+			"z":     1,
+			"a":     "plain",
+			"empty": "",
+			"err":   errors.New("a=b"),
+			"multi": "line1\nline2\\",
+			"msg":   "collides",
+		},
+	}
+	if err := o.Write(ld); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `time=2014-01-02T03:04:05Z level=warn msg="say \"hi\"" ` +
+		`caller=logfmtoutput_test.go:12 a=plain empty="" err="a=b" ` +
+		`fields.msg=collides multi="line1\nline2\\" z=1` + "\n"
+	if got := buffer.String(); got != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, got)
+	}
+}
+
+// An error whose Error method panics when called on a nil pointer.
+type logfmtTestError struct{ msg string }
+
+func (e *logfmtTestError) Error() string { return e.msg }
+
+func TestLogfmtOutputNilError(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	o, err := NewLogfmtOutput(buffer, FieldKeys{Message: "msg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e *logfmtTestError
+	ld := &LineData{Message: "x", Fields: map[string]interface{}{"err": error(e)}}
+	if err := o.Write(ld); err != nil {
+		t.Fatal(err)
+	}
+	if got := buffer.String(); got != "msg=x err=<nil>\n" {
+		t.Fatalf("Unexpected output %q", got)
+	}
+}
@@ -5,7 +5,10 @@ package logray
 import (
 	"fmt"
 	"net/url"
+	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,13 +16,27 @@ import (
 // the application. It exposes all of the functions for log levels, fields for
 // additional metadata, and has the outputs for log data associated with it.
 type Logger struct {
-	// Fields represents metadata that has been captured to be associated with the
-	// log messages.
-	Fields map[string]interface{}
+	// The union of the classes configured on the outputs, cached along with
+	// the value of classGeneration it was computed at. The generation is held
+	// in the upper 32 bits and the classes in the lower 32 bits. This must be
+	// accessed atomically, and is kept first for alignment on 32 bit platforms.
+	classCache uint64
+
+	// The hierarchical name of the Logger, set by Named.
+	name string
+
+	// The fields associated with the log messages, and the mutex protecting
+	// which node the Logger points at. The nodes themselves are immutable.
+	fields     *fieldNode
+	fieldMutex sync.RWMutex
 
 	// The outputs configured on the current logger
 	outputs     []*loggerOutputWrapper
 	outputMutex sync.RWMutex
+
+	// The outputs of the Logger which are recorded in loggerOutputs, or nil if
+	// there are none. Protected by outputMutex.
+	tracked *trackedOutputs
 }
 
 // loggerOutputWrapper is used to match the specific output to the log classes
@@ -27,14 +44,31 @@ type Logger struct {
 // intended for re-use of instantiated outputs, where the multiple outputs may
 // be configured for different log levels.
 type loggerOutputWrapper struct {
-	// The configured log class out of the specific output
-	Class LogClass
+	// The configured log class out of the specific output. Wrappers are shared
+	// by every Logger created with them, so this may be changed while other
+	// goroutines are logging and must only be accessed with Class and setClass.
+	class uint32
 
 	// The Output the wrapper represents.
 	OutputWrapper *outputWrapper
 }
 
+// Class returns the classes logged to the output.
+func (lo *loggerOutputWrapper) Class() LogClass {
+	return LogClass(atomic.LoadUint32(&lo.class))
+}
+
+// setClass changes the classes logged to the output. Callers must increment
+// classGeneration afterwards so that Loggers notice the change.
+func (lo *loggerOutputWrapper) setClass(class LogClass) {
+	atomic.StoreUint32(&lo.class, uint32(class))
+}
+
 var (
+	// ExitFunc is called by Fatal and Fatalf once the log line has been flushed
+	// to all outputs. It can be replaced in order to test code that calls Fatal.
+	ExitFunc = os.Exit
+
 	// defaultOutputs defines a list of outputs that will be added to a newly
 	// created Logger.
 	defaultOutputs []*loggerOutputWrapper
@@ -42,15 +76,89 @@ var (
 	// defaultOutputMutex handles locking around the array of default outputs to
 	// add to a new Logger.
 	defaultOutputMutex sync.RWMutex
+
+	// classGeneration is incremented whenever the classes of any Logger's
+	// outputs may have changed, which invalidates every Logger's classCache.
+	// It starts at 1 so that a zero classCache is never considered valid. This
+	// must be accessed atomically.
+	classGeneration uint32 = 1
+
+	// loggerOutputs records the outputs created for individual Loggers by
+	// AddOutput and UpdateOutput so that AdminHandler can list and change them.
+	// Each is mapped to the number of Loggers using it under each name, and is
+	// removed once no Logger uses it. Protected by loggerOutputMutex.
+	loggerOutputs     = make(map[*loggerOutputWrapper]map[string]int)
+	loggerOutputMutex sync.Mutex
 )
 
+// trackedOutputs holds the outputs of a Logger which are recorded in
+// loggerOutputs. It is kept apart from the Logger so that a finalizer can
+// release the outputs once the Logger has been garbage collected, without
+// requiring that the Logger be allocated on its own.
+type trackedOutputs struct {
+	name    string
+	outputs []*loggerOutputWrapper
+}
+
+// release removes the Logger's uses of its outputs from loggerOutputs.
+func (t *trackedOutputs) release() {
+	loggerOutputMutex.Lock()
+	t.lockedRelease()
+	loggerOutputMutex.Unlock()
+}
+
+// lockedRelease is release for callers which hold loggerOutputMutex.
+func (t *trackedOutputs) lockedRelease() {
+	for _, lo := range t.outputs {
+		names := loggerOutputs[lo]
+		if names[t.name]--; names[t.name] <= 0 {
+			delete(names, t.name)
+		}
+		if len(names) == 0 {
+			delete(loggerOutputs, lo)
+		}
+	}
+	t.outputs = nil
+}
+
+// lockedTrackOutputs updates loggerOutputs after the Logger's outputs have
+// changed. Any outputs created for the Logger must be given as added. The
+// Logger's outputMutex must be held unless no other goroutine can access it.
+func (logger *Logger) lockedTrackOutputs(added ...*loggerOutputWrapper) {
+	loggerOutputMutex.Lock()
+	defer loggerOutputMutex.Unlock()
+	for _, lo := range added {
+		if loggerOutputs[lo] == nil {
+			loggerOutputs[lo] = make(map[string]int)
+		}
+	}
+
+	// The new outputs are counted before the old ones are released so that
+	// outputs the Logger still uses are never removed.
+	var outputs []*loggerOutputWrapper
+	for _, lo := range logger.outputs {
+		if names, ok := loggerOutputs[lo]; ok {
+			names[logger.name]++
+			outputs = append(outputs, lo)
+		}
+	}
+	if logger.tracked == nil {
+		if len(outputs) == 0 {
+			return
+		}
+		logger.tracked = &trackedOutputs{name: logger.name}
+		runtime.SetFinalizer(logger.tracked, (*trackedOutputs).release)
+	}
+	logger.tracked.lockedRelease()
+	logger.tracked.outputs = outputs
+}
+
 // New returns a new Logger with the default configuration.
 func New() *Logger {
 	defaultOutputMutex.RLock()
 	defer defaultOutputMutex.RUnlock()
 
 	logger := &Logger{
-		Fields:  make(map[string]interface{}),
 		outputs: make([]*loggerOutputWrapper, len(defaultOutputs)),
 	}
 	copy(logger.outputs, defaultOutputs)
@@ -86,13 +194,35 @@ func ResetDefaultOutput() {
 }
 
 // ResetCachedOutputs clears all the cached outputs that were previously
-// instantiated.
+// instantiated, so that outputs created afterwards are opened again. The
+// outputs are not closed, as existing Loggers and the default outputs continue
+// to write to them. Use CloseCachedOutputs to close them as well.
 func ResetCachedOutputs() {
 	updateMutex.Lock()
 	defer updateMutex.Unlock()
 	lockedSetupOutputMap()
 }
 
+// CloseCachedOutputs clears all the cached outputs in the same way as
+// ResetCachedOutputs, and also flushes and closes each of them once the lines
+// already queued for it have been written. Lines sent to a closed output by
+// existing Loggers are discarded. As the default outputs use these outputs they
+// are cleared as well, in the same way as ResetDefaultOutput. This also allows
+// logging to resume after Shutdown.
+func CloseCachedOutputs() {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	for _, ow := range outputMap {
+		closeOutput(ow)
+	}
+	lockedSetupOutputMap()
+	atomic.StoreInt32(&shutdownState, 0)
+
+	defaultOutputMutex.Lock()
+	defaultOutputs = make([]*loggerOutputWrapper, 0)
+	defaultOutputMutex.Unlock()
+}
+
 // ResetDefaultLogLevel can be used to reconfigure the existing default outputs
 // all be at a new log level.
 func ResetDefaultLogLevel(classes ...LogClass) {
@@ -104,27 +234,34 @@ func ResetDefaultLogLevel(classes ...LogClass) {
 
 	defaultOutputMutex.Lock()
 	for _, o := range defaultOutputs {
-		o.Class = class
+		o.setClass(class)
 	}
 	defaultOutputMutex.Unlock()
+	atomic.AddUint32(&classGeneration, 1)
 }
 
 // Clone returns a new Logger object and copies over the configuration and all
-// fields along with it.
+// fields along with it. The fields are shared with the original Logger rather
+// than copied, so this is cheap regardless of how many fields are set.
 func (logger *Logger) Clone() *Logger {
-	clone := &Logger{}
+	return logger.clone(logger.name)
+}
+
+// clone implements Clone, giving the new Logger the given name.
+func (logger *Logger) clone(name string) *Logger {
+	clone := &Logger{name: name}
 
 	// copy the outputs
 	logger.outputMutex.RLock()
 	clone.outputs = make([]*loggerOutputWrapper, len(logger.outputs))
 	copy(clone.outputs, logger.outputs)
 	logger.outputMutex.RUnlock()
+	clone.lockedTrackOutputs()
 
-	// copy the fields
-	clone.Fields = make(map[string]interface{}, len(logger.Fields))
-	for k, v := range logger.Fields {
-		clone.Fields[k] = v
-	}
+	// share the fields, which are never modified in place
+	logger.fieldMutex.RLock()
+	clone.fields = logger.fields
+	logger.fieldMutex.RUnlock()
 	return clone
 }
 
@@ -143,6 +280,8 @@ func (logger *Logger) AddOutput(uri string, classes ...LogClass) error {
 	logger.outputMutex.Lock()
 	defer logger.outputMutex.Unlock()
 	logger.outputs = append(logger.outputs, lo)
+	logger.lockedTrackOutputs(lo)
+	atomic.AddUint32(&classGeneration, 1)
 	return nil
 }
 
@@ -162,15 +301,19 @@ func (logger *Logger) UpdateOutput(uri string, classes ...LogClass) error {
 	}
 
 	newoutputs := make([]*loggerOutputWrapper, 0)
+	var added []*loggerOutputWrapper
 	// Lock our outputs
 	logger.outputMutex.Lock()
 	defer logger.outputMutex.Unlock()
+	defer atomic.AddUint32(&classGeneration, 1)
+	defer func() { logger.lockedTrackOutputs(added...) }()
 	for i, o := range logger.outputs {
-		if (o.Class == class || o.Class&class != 0) && u.Scheme == o.OutputWrapper.URL.Scheme {
+		current := o.Class()
+		if (current == class || current&class != 0) && u.Scheme == o.OutputWrapper.URL.Scheme {
 			// Found a match
 
 			// generate it with new uri for intersection of given classes and output's classes.
-			lo, err := createOutputWrapperForClass(uri, o.Class&class)
+			lo, err := createOutputWrapperForClass(uri, current&class)
 			if err != nil {
 				return err
 			}
@@ -179,12 +322,13 @@ func (logger *Logger) UpdateOutput(uri string, classes ...LogClass) error {
 			}
 
 			logger.outputs[i] = lo
+			added = append(added, lo)
 
 			// Save this output for rest of the classes not being updated.
 			// Add these later outside the loop so that these are not updated.
-			restClasses := (o.Class ^ class) & o.Class
+			restClasses := (current ^ class) & current
 			if restClasses != NONE && restClasses != isPLUSDEF {
-				o.Class = restClasses
+				o.setClass(restClasses)
 				newoutputs = append(newoutputs, o)
 			}
 		}
@@ -199,7 +343,9 @@ func (logger *Logger) UpdateOutput(uri string, classes ...LogClass) error {
 func (logger *Logger) ResetOutput() {
 	logger.outputMutex.Lock()
 	logger.outputs = make([]*loggerOutputWrapper, 0)
+	logger.lockedTrackOutputs()
 	logger.outputMutex.Unlock()
+	atomic.AddUint32(&classGeneration, 1)
 }
 
 // createOutputWrapper generates a new loggerOutputWrapper based on the passed
@@ -232,41 +378,18 @@ func createOutputWrapperForClass(uri string, class LogClass) (*loggerOutputWrapp
 	}
 
 	// generate the wrapper
-	lo := &loggerOutputWrapper{Class: class, OutputWrapper: ow}
+	lo := &loggerOutputWrapper{class: uint32(class), OutputWrapper: ow}
 	return lo, nil
 }
 
-// ClearFields resets the Field on the Logger.
-func (logger *Logger) ClearFields() {
-	logger.Fields = make(map[string]interface{})
-}
-
-// RemoveFields will remove any of the mentioned keys from the Logger's Fields.
-func (logger *Logger) RemoveFields(keys ...string) {
-	for _, s := range keys {
-		delete(logger.Fields, s)
-	}
-}
-
-// SetFields can be used to copy all of the values in the provided fields map to
-// the current Logger.
-func (logger *Logger) SetFields(fields map[string]interface{}) {
-	for k, v := range fields {
-		logger.Fields[k] = v
-	}
-}
-
-// SetField is used to set the specified field to the provided value on the
-// current Logger.
-func (logger *Logger) SetField(key string, value interface{}) {
-	logger.Fields[key] = value
-}
-
 // Injects a log in the trace class for this category if logging for this
 // category is enabled, otherwise this does nothing. This will format the given
 // arguments using fmt.Sprint. If a format string is desired then use Tracef()
 // instead.
 func (logger *Logger) Trace(args ...interface{}) {
+	if !logger.Enabled(TRACE) {
+		return
+	}
 	logger.log(TRACE, fmt.Sprint(args...))
 }
 
@@ -274,6 +397,9 @@ func (logger *Logger) Trace(args ...interface{}) {
 // category is enabled, otherwise this does nothing. This formats the log line
 // using the format string provided (See fmt.Sprintf).
 func (logger *Logger) Tracef(format string, args ...interface{}) {
+	if !logger.Enabled(TRACE) {
+		return
+	}
 	logger.log(TRACE, fmt.Sprintf(format, args...))
 }
 
@@ -282,6 +408,9 @@ func (logger *Logger) Tracef(format string, args ...interface{}) {
 // arguments using fmt.Sprint. If a format string is desired then use Debugf()
 // instead.
 func (logger *Logger) Debug(args ...interface{}) {
+	if !logger.Enabled(DEBUG) {
+		return
+	}
 	logger.log(DEBUG, fmt.Sprint(args...))
 }
 
@@ -289,6 +418,9 @@ func (logger *Logger) Debug(args ...interface{}) {
 // category is enabled, otherwise this does nothing. This formats the log line
 // using the format string provided (See fmt.Sprintf).
 func (logger *Logger) Debugf(format string, args ...interface{}) {
+	if !logger.Enabled(DEBUG) {
+		return
+	}
 	logger.log(DEBUG, fmt.Sprintf(format, args...))
 }
 
@@ -297,6 +429,9 @@ func (logger *Logger) Debugf(format string, args ...interface{}) {
 // arguments using fmt.Sprint. If a format string is desired then use Infof()
 // instead.
 func (logger *Logger) Info(args ...interface{}) {
+	if !logger.Enabled(INFO) {
+		return
+	}
 	logger.log(INFO, fmt.Sprint(args...))
 }
 
@@ -304,6 +439,9 @@ func (logger *Logger) Info(args ...interface{}) {
 // category is enabled, otherwise this does nothing. This formats the log line
 // using the format string provided (See fmt.Sprintf).
 func (logger *Logger) Infof(format string, args ...interface{}) {
+	if !logger.Enabled(INFO) {
+		return
+	}
 	logger.log(INFO, fmt.Sprintf(format, args...))
 }
 
@@ -312,6 +450,9 @@ func (logger *Logger) Infof(format string, args ...interface{}) {
 // arguments using fmt.Sprint. If a format string is desired then use Warnf()
 // instead.
 func (logger *Logger) Warn(args ...interface{}) {
+	if !logger.Enabled(WARN) {
+		return
+	}
 	logger.log(WARN, fmt.Sprint(args...))
 }
 
@@ -319,6 +460,9 @@ func (logger *Logger) Warn(args ...interface{}) {
 // category is enabled, otherwise this does nothing. This formats the log line
 // using the format string provided (See fmt.Sprintf).
 func (logger *Logger) Warnf(format string, args ...interface{}) {
+	if !logger.Enabled(WARN) {
+		return
+	}
 	logger.log(WARN, fmt.Sprintf(format, args...))
 }
 
@@ -327,6 +471,9 @@ func (logger *Logger) Warnf(format string, args ...interface{}) {
 // arguments using fmt.Sprint. If a format string is desired then use Errorf()
 // instead.
 func (logger *Logger) Error(args ...interface{}) {
+	if !logger.Enabled(ERROR) {
+		return
+	}
 	logger.log(ERROR, fmt.Sprint(args...))
 }
 
@@ -334,29 +481,125 @@ func (logger *Logger) Error(args ...interface{}) {
 // category is enabled, otherwise this does nothing. This formats the log line
 // using the format string provided (See fmt.Sprintf).
 func (logger *Logger) Errorf(format string, args ...interface{}) {
+	if !logger.Enabled(ERROR) {
+		return
+	}
 	logger.log(ERROR, fmt.Sprintf(format, args...))
 }
 
+// Injects a log in the fatal class for this category, flushes all outputs, and
+// then exits the process by calling ExitFunc with a status of 1. This will
+// format the given arguments using fmt.Sprint. If a format string is desired
+// then use Fatalf() instead.
+func (logger *Logger) Fatal(args ...interface{}) {
+	if logger.Enabled(FATAL) {
+		logger.log(FATAL, fmt.Sprint(args...))
+	}
+	logger.flushAll()
+	ExitFunc(1)
+}
+
+// Injects a log in the fatal class for this category, flushes all outputs, and
+// then exits the process by calling ExitFunc with a status of 1. This formats
+// the log line using the format string provided (See fmt.Sprintf).
+func (logger *Logger) Fatalf(format string, args ...interface{}) {
+	if logger.Enabled(FATAL) {
+		logger.log(FATAL, fmt.Sprintf(format, args...))
+	}
+	logger.flushAll()
+	ExitFunc(1)
+}
+
+// Injects a log in the fatal class for this category, flushes all outputs, and
+// then panics with the log message. This will format the given arguments using
+// fmt.Sprint. If a format string is desired then use Panicf() instead.
+func (logger *Logger) Panic(args ...interface{}) {
+	message := fmt.Sprint(args...)
+	logger.log(FATAL, message)
+	logger.flushAll()
+	panic(message)
+}
+
+// Injects a log in the fatal class for this category, flushes all outputs, and
+// then panics with the log message. This formats the log line using the format
+// string provided (See fmt.Sprintf).
+func (logger *Logger) Panicf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	logger.log(FATAL, message)
+	logger.flushAll()
+	panic(message)
+}
+
 // log is the internal function which creates the line data for the message and
-// pushes it onto the transit channel.
+// pushes it onto the queue of each output configured for the class.
 func (logger *Logger) log(logClass LogClass, message string) {
-	ld := logger.newLineData(logClass, message)
-	b := &backgroundLineLogger{
-		lineData: *ld,
-		logger:   logger,
+	if isShutdown() {
+		return
+	}
+	logger.write(logger.newLineData(logClass, message))
+}
+
+// write pushes the line onto the queue of each output configured for its class.
+func (logger *Logger) write(ld *LineData) {
+	if logger.enabledClasses()&ld.Class != ld.Class {
+		return
+	}
+
+	// Copy the matching outputs so the lock is not held while queuing, which
+	// may block if an output has fallen behind.
+	logger.outputMutex.RLock()
+	outputs := make([]*outputWrapper, 0, len(logger.outputs))
+	for _, o := range logger.outputs {
+		if o.Class()&ld.Class == ld.Class {
+			outputs = append(outputs, o.OutputWrapper)
+		}
+	}
+	logger.outputMutex.RUnlock()
+
+	// All outputs share the same LineData, which is why they must not modify it.
+	// Outputs with space are given the line first, so that an output which is
+	// full does not delay the line reaching the others.
+	b := &backgroundLineLogger{lineData: ld}
+	var full []*outputWrapper
+	for _, ow := range outputs {
+		if ow.queue.full() {
+			full = append(full, ow)
+		} else {
+			ow.enqueue(b)
+		}
+	}
+	for _, ow := range full {
+		ow.enqueue(b)
 	}
-	transitChannel <- b
 }
 
 // Flush is used to ensure the logger has flushed all queued log lines to its
 // outputs before returning.
 func (logger *Logger) Flush() {
-	b := &backgroundFlusher{
-		logger:     logger,
-		updateChan: make(chan struct{}),
+	logger.outputMutex.RLock()
+	outputs := uniqueOutputs(logger.outputs)
+	logger.outputMutex.RUnlock()
+	flushOutputs(outputs)
+}
+
+// flushAll flushes the outputs on the logger as well as every cached output,
+// which ensures that anything queued by other Loggers is written as well. This
+// is used prior to terminating the process.
+func (logger *Logger) flushAll() {
+	logger.outputMutex.RLock()
+	outputs := uniqueOutputs(logger.outputs)
+	logger.outputMutex.RUnlock()
+
+	seen := make(map[*outputWrapper]bool, len(outputs))
+	for _, ow := range outputs {
+		seen[ow] = true
+	}
+	for _, ow := range cachedOutputs() {
+		if !seen[ow] {
+			outputs = append(outputs, ow)
+		}
 	}
-	transitChannel <- b
-	<-b.updateChan
+	flushOutputs(outputs)
 }
 
 // newLineData creates the struct that wraps a log message and will capture the
@@ -366,16 +609,42 @@ func (logger *Logger) newLineData(logClass LogClass, message string) *LineData {
 		Message:   message,
 		Class:     logClass,
 		TimeStamp: time.Now(),
+		Name:      logger.name,
 	}
 
-	ld.Fields = make(map[string]interface{}, len(logger.Fields))
-	for k, v := range logger.Fields {
-		ld.Fields[k] = v
-	}
-
+	ld.Fields = logger.copyFields()
 	packageFilenameLine(ld, 4)
 	if logClass == ERROR {
 		ld.Fields["stack"] = gatherStack()
 	}
 	return ld
 }
+
+// Enabled returns true if any of the Logger's outputs is configured for the
+// given class, and the class is enabled for the Logger's name. The level
+// methods check this before doing any work, so this only needs to be called
+// directly in order to avoid computing expensive arguments.
+func (logger *Logger) Enabled(class LogClass) bool {
+	return logger.enabledClasses()&class == class && !isShutdown()
+}
+
+// enabledClasses returns the union of the classes configured on the Logger's
+// outputs, limited to those configured for the Logger's name. This is cached
+// until the outputs of any Logger or the classes of any name change.
+func (logger *Logger) enabledClasses() LogClass {
+	generation := atomic.LoadUint32(&classGeneration)
+	cache := atomic.LoadUint64(&logger.classCache)
+	if uint32(cache>>32) == generation {
+		return LogClass(cache)
+	}
+
+	logger.outputMutex.RLock()
+	class := NONE
+	for _, o := range logger.outputs {
+		class |= o.Class()
+	}
+	logger.outputMutex.RUnlock()
+	class &= lookupNameClasses(logger.name)
+	atomic.StoreUint64(&logger.classCache, uint64(generation)<<32|uint64(class))
+	return class
+}
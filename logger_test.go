@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 )
 
 const (
@@ -387,3 +388,250 @@ func TestUpdateOutputSchemeMatch(t *testing.T) {
 		t.Fatalf("Output: %v", debugPlusOutput.OutputWrapper)
 	}
 }
+
+// testOutput is an Output that records every line written to it.
+type testOutput struct {
+	lines   []*LineData
+	flushes int
+}
+
+func (o *testOutput) Write(ld *LineData) error {
+	o.lines = append(o.lines, ld)
+	return nil
+}
+
+func (o *testOutput) Flush() error {
+	o.flushes++
+	return nil
+}
+
+// newTestOutputLogger returns a Logger that only writes to a new testOutput
+// registered under the given scheme.
+func newTestOutputLogger(t *testing.T, scheme string, classes ...LogClass) (*Logger, *testOutput) {
+	o := &testOutput{}
+	ResetCachedOutputs()
+	AddNewOutputFunc(scheme, func(u *url.URL) (Output, error) {
+		return o, nil
+	})
+	logger := New()
+	logger.ResetOutput()
+	if err := logger.AddOutput(scheme+"://", classes...); err != nil {
+		t.Fatal(err)
+	}
+	return logger, o
+}
+
+func TestLoggerFatal(t *testing.T) {
+	logger, o := newTestOutputLogger(t, "testfatal", ALL)
+
+	defer func(f func(int)) { ExitFunc = f }(ExitFunc)
+	code := -1
+	ExitFunc = func(c int) {
+		// The line must have been written and flushed prior to exiting.
+		if len(o.lines) != 1 || o.flushes == 0 {
+			t.Fatalf("Exit called before flushing: %d lines, %d flushes", len(o.lines), o.flushes)
+		}
+		code = c
+	}
+
+	logger.Fatalf("fatal %d", 1)
+	if code != 1 {
+		t.Fatalf("Expected exit code 1, got %d", code)
+	}
+	if o.lines[0].Class != FATAL || o.lines[0].Message != "fatal 1" {
+		t.Fatalf("Unexpected line: %#v", o.lines[0])
+	}
+	if o.lines[0].SourceFile != "logger_test.go" {
+		t.Fatalf("Unexpected source file: %s", o.lines[0].SourceFile)
+	}
+}
+
+func TestLoggerPanic(t *testing.T) {
+	logger, o := newTestOutputLogger(t, "testpanic", ALL)
+
+	defer func() {
+		r := recover()
+		if r != "panic 1" {
+			t.Fatalf("Unexpected panic value: %v", r)
+		}
+		if len(o.lines) != 1 || o.lines[0].Class != FATAL || o.flushes == 0 {
+			t.Fatalf("Line not flushed prior to panic: %d lines, %d flushes", len(o.lines), o.flushes)
+		}
+	}()
+	logger.Panic("panic ", 1)
+}
+
+// blockingOutput is an Output whose Write blocks until release is closed.
+type blockingOutput struct {
+	release chan struct{}
+}
+
+func (o *blockingOutput) Write(ld *LineData) error {
+	<-o.release
+	return nil
+}
+
+func (o *blockingOutput) Flush() error { return nil }
+
+func TestLoggerSlowOutputIsolation(t *testing.T) {
+	blocked := &blockingOutput{release: make(chan struct{})}
+	defer close(blocked.release)
+	ResetCachedOutputs()
+	AddNewOutputFunc("testblocked", func(u *url.URL) (Output, error) {
+		return blocked, nil
+	})
+	slow := New()
+	slow.ResetOutput()
+	if err := slow.AddOutput("testblocked://", ALL); err != nil {
+		t.Fatal(err)
+	}
+	fast, o := newTestOutputLogger(t, "testisolation", ALL)
+
+	// Fill the blocked output's queue while its goroutine is stuck.
+	for i := 0; i < DefaultQueueSize; i++ {
+		slow.Info("stuck")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*DefaultQueueSize; i++ {
+			fast.Info("flowing")
+		}
+		fast.Flush()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A blocked output stalled an unrelated logger.")
+	}
+	if len(o.lines) != 2*DefaultQueueSize {
+		t.Fatalf("Expected %d lines, got %d", 2*DefaultQueueSize, len(o.lines))
+	}
+}
+
+// notifyOutput sends the message of each line written to a channel.
+type notifyOutput struct {
+	lines chan string
+}
+
+func (o *notifyOutput) Write(ld *LineData) error {
+	o.lines <- ld.Message
+	return nil
+}
+
+func (o *notifyOutput) Flush() error { return nil }
+
+func TestLoggerFullOutputDoesNotDelayOthers(t *testing.T) {
+	blocked := &blockingOutput{release: make(chan struct{})}
+	notify := &notifyOutput{lines: make(chan string, 10)}
+	ResetCachedOutputs()
+	AddNewOutputFunc("testfull", func(u *url.URL) (Output, error) {
+		return blocked, nil
+	})
+	AddNewOutputFunc("testnotfull", func(u *url.URL) (Output, error) {
+		return notify, nil
+	})
+	logger := New()
+	logger.ResetOutput()
+	if err := logger.AddOutput("testfull://?queue=1", ALL); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.AddOutput("testnotfull://", ALL); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first line is stuck in Write and the second fills the queue, so the
+	// third blocks the caller, but only once the other output has it.
+	go func() {
+		for _, m := range []string{"one", "two", "three"} {
+			logger.Info(m)
+		}
+	}()
+	for _, expected := range []string{"one", "two", "three"} {
+		select {
+		case m := <-notify.lines:
+			if m != expected {
+				t.Fatalf("Expected %q, got %q", expected, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("A full output delayed the line %q to another output.", expected)
+		}
+	}
+	close(blocked.release)
+}
+
+func TestLoggerEnabled(t *testing.T) {
+	logger, o := newTestOutputLogger(t, "testenabled", WARNPLUS)
+	if logger.Enabled(INFO) || !logger.Enabled(WARN) || !logger.Enabled(FATAL) {
+		t.Fatal("Enabled does not match the configured classes.")
+	}
+
+	// The cached classes must be invalidated when outputs change.
+	if err := logger.AddOutput("testenabled://", DEBUG); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.Enabled(DEBUG) {
+		t.Fatal("Enabled was not updated by AddOutput.")
+	}
+	logger.ResetOutput()
+	if logger.Enabled(WARN) {
+		t.Fatal("Enabled was not updated by ResetOutput.")
+	}
+
+	// Arguments to disabled levels must not be formatted, even while an output
+	// is configured for other classes.
+	if err := logger.AddOutput("testenabled://", ERROR); err != nil {
+		t.Fatal(err)
+	}
+	formatted := &formatRecorder{}
+	logger.Warn(formatted)
+	logger.Warnf("%v", formatted)
+	logger.Error("error")
+	logger.Flush()
+	if formatted.called {
+		t.Fatal("The arguments of a disabled line were formatted.")
+	} else if len(o.lines) != 1 || o.lines[0].Message != "error" {
+		t.Fatalf("Expected only the error line, got %d lines", len(o.lines))
+	}
+}
+
+// formatRecorder records whether it has been formatted.
+type formatRecorder struct {
+	called bool
+}
+
+func (r *formatRecorder) String() string {
+	r.called = true
+	return "formatted"
+}
+
+func BenchmarkLoggerDisabled(b *testing.B) {
+	logger := New()
+	logger.ResetOutput()
+	if err := logger.AddOutput("discard://", ERROR); err != nil {
+		b.Fatal(err)
+	}
+	logger.SetField("key", "value")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logger.Debugf("line %d", i)
+	}
+}
+
+func BenchmarkLoggerEnabled(b *testing.B) {
+	logger := New()
+	logger.ResetOutput()
+	if err := logger.AddOutput("discard://?overflow=drop", DEBUG); err != nil {
+		b.Fatal(err)
+	}
+	logger.SetField("key", "value")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logger.Debugf("line %d", i)
+	}
+	b.StopTimer()
+	logger.Flush()
+}
@@ -0,0 +1,408 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// The largest string, binary, array or map that msgpackDecoder will accept,
+// which prevents a corrupt length from causing a huge allocation.
+const msgpackMaxLength = 64 * 1024 * 1024
+
+// The extension type used by the Fluentd Forward protocol for EventTime.
+const msgpackEventTimeType = 0
+
+// msgpackEncoder appends MessagePack encoded values to a buffer. Only the parts
+// of the format needed by the outputs are implemented.
+type msgpackEncoder struct {
+	b *bytes.Buffer
+}
+
+// Writes a nil.
+func (e msgpackEncoder) writeNil() {
+	e.b.WriteByte(0xc0)
+}
+
+// Writes a boolean.
+func (e msgpackEncoder) writeBool(v bool) {
+	if v {
+		e.b.WriteByte(0xc3)
+	} else {
+		e.b.WriteByte(0xc2)
+	}
+}
+
+// Writes a signed integer using the smallest encoding.
+func (e msgpackEncoder) writeInt(v int64) {
+	switch {
+	case v >= 0:
+		e.writeUint(uint64(v))
+	case v >= -32:
+		e.b.WriteByte(byte(v))
+	case v >= math.MinInt8:
+		e.b.Write([]byte{0xd0, byte(v)})
+	case v >= math.MinInt16:
+		e.b.WriteByte(0xd1)
+		e.writeUint16(uint16(v))
+	case v >= math.MinInt32:
+		e.b.WriteByte(0xd2)
+		e.writeUint32(uint32(v))
+	default:
+		e.b.WriteByte(0xd3)
+		e.writeUint64(uint64(v))
+	}
+}
+
+// Writes an unsigned integer using the smallest encoding.
+func (e msgpackEncoder) writeUint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		e.b.WriteByte(byte(v))
+	case v <= math.MaxUint8:
+		e.b.Write([]byte{0xcc, byte(v)})
+	case v <= math.MaxUint16:
+		e.b.WriteByte(0xcd)
+		e.writeUint16(uint16(v))
+	case v <= math.MaxUint32:
+		e.b.WriteByte(0xce)
+		e.writeUint32(uint32(v))
+	default:
+		e.b.WriteByte(0xcf)
+		e.writeUint64(v)
+	}
+}
+
+// Writes a 64 bit float.
+func (e msgpackEncoder) writeFloat(v float64) {
+	e.b.WriteByte(0xcb)
+	e.writeUint64(math.Float64bits(v))
+}
+
+// Writes a string.
+func (e msgpackEncoder) writeString(s string) {
+	switch n := len(s); {
+	case n <= 31:
+		e.b.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.b.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		e.b.WriteByte(0xda)
+		e.writeUint16(uint16(n))
+	default:
+		e.b.WriteByte(0xdb)
+		e.writeUint32(uint32(n))
+	}
+	e.b.WriteString(s)
+}
+
+// Writes binary data.
+func (e msgpackEncoder) writeBin(p []byte) {
+	switch n := len(p); {
+	case n <= math.MaxUint8:
+		e.b.Write([]byte{0xc4, byte(n)})
+	case n <= math.MaxUint16:
+		e.b.WriteByte(0xc5)
+		e.writeUint16(uint16(n))
+	default:
+		e.b.WriteByte(0xc6)
+		e.writeUint32(uint32(n))
+	}
+	e.b.Write(p)
+}
+
+// Writes the header of an array with n elements, which must follow.
+func (e msgpackEncoder) writeArrayHeader(n int) {
+	switch {
+	case n <= 15:
+		e.b.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		e.b.WriteByte(0xdc)
+		e.writeUint16(uint16(n))
+	default:
+		e.b.WriteByte(0xdd)
+		e.writeUint32(uint32(n))
+	}
+}
+
+// Writes the header of a map with n pairs, which must follow.
+func (e msgpackEncoder) writeMapHeader(n int) {
+	switch {
+	case n <= 15:
+		e.b.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		e.b.WriteByte(0xde)
+		e.writeUint16(uint16(n))
+	default:
+		e.b.WriteByte(0xdf)
+		e.writeUint32(uint32(n))
+	}
+}
+
+// Writes a time as a Fluentd EventTime, which is an 8 byte extension holding
+// the seconds and nanoseconds since the epoch.
+func (e msgpackEncoder) writeEventTime(t time.Time) {
+	e.b.Write([]byte{0xd7, msgpackEventTimeType})
+	e.writeUint32(uint32(t.Unix()))
+	e.writeUint32(uint32(t.Nanosecond()))
+}
+
+// Writes an arbitrary value. Maps with string keys, slices and the basic types
+// are encoded directly, errors are written as their Error() string and times
+// in RFC 3339 format, and anything else is converted to a string with fmt.
+// Errors and Stringers are formatted with fmt so that a method which panics,
+// such as one called on a nil pointer, is reported in the string rather than
+// stopping the output.
+func (e msgpackEncoder) writeValue(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		e.writeNil()
+		return
+	case string:
+		e.writeString(v)
+		return
+	case []byte:
+		e.writeBin(v)
+		return
+	case error:
+		e.writeString(fmt.Sprint(v))
+		return
+	case time.Time:
+		e.writeString(v.Format(time.RFC3339Nano))
+		return
+	case fmt.Stringer:
+		// Types such as time.Duration are more useful as their string form than
+		// as their underlying numeric value.
+		if reflect.TypeOf(v).PkgPath() != "" {
+			e.writeString(fmt.Sprint(v))
+			return
+		}
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		e.writeBool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		e.writeFloat(rv.Float())
+	case reflect.String:
+		e.writeString(rv.String())
+	case reflect.Slice, reflect.Array:
+		e.writeArrayHeader(rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			e.writeValue(rv.Index(i).Interface())
+		}
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			e.writeString(fmt.Sprintf("%+v", v))
+			return
+		}
+		keys := rv.MapKeys()
+		e.writeMapHeader(len(keys))
+		for _, k := range keys {
+			e.writeString(k.String())
+			e.writeValue(rv.MapIndex(k).Interface())
+		}
+	default:
+		e.writeString(fmt.Sprintf("%+v", v))
+	}
+}
+
+func (e msgpackEncoder) writeUint16(v uint16) {
+	var p [2]byte
+	binary.BigEndian.PutUint16(p[:], v)
+	e.b.Write(p[:])
+}
+
+func (e msgpackEncoder) writeUint32(v uint32) {
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[:], v)
+	e.b.Write(p[:])
+}
+
+func (e msgpackEncoder) writeUint64(v uint64) {
+	var p [8]byte
+	binary.BigEndian.PutUint64(p[:], v)
+	e.b.Write(p[:])
+}
+
+// msgpackExt is a decoded MessagePack extension value.
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+// msgpackDecoder reads MessagePack values from a stream.
+type msgpackDecoder struct {
+	r *bufio.Reader
+}
+
+// Reads the next value. Integers are returned as int64, or as uint64 if they
+// are too large, floats as float64, strings as string, binary data as []byte,
+// arrays as []interface{}, maps as map[string]interface{} with non-string keys
+// formatted with fmt, and extensions as msgpackExt.
+func (d msgpackDecoder) decode() (interface{}, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.decodeString(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readLength(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.readBytes(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.readLength(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(n)
+	case 0xca:
+		v, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.readUint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.readUint(1 << (c - 0xcc))
+		if v > math.MaxInt64 {
+			return v, err
+		}
+		return int64(v), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		v, err := d.readUint(size)
+		// Sign extend from the encoded size.
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readLength(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(n)
+	case 0xdc, 0xdd:
+		n, err := d.readLength(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n)
+	case 0xde, 0xdf:
+		n, err := d.readLength(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n)
+	}
+	return nil, fmt.Errorf("Invalid MessagePack type: 0x%02x", c)
+}
+
+func (d msgpackDecoder) decodeString(n int) (interface{}, error) {
+	p, err := d.readBytes(n)
+	return string(p), err
+}
+
+func (d msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	a := make([]interface{}, n)
+	for i := range a {
+		var err error
+		if a[i], err = d.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (d msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := k.(string); ok {
+			m[s] = v
+		} else {
+			m[fmt.Sprint(k)] = v
+		}
+	}
+	return m, nil
+}
+
+func (d msgpackDecoder) decodeExt(n int) (interface{}, error) {
+	t, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	p, err := d.readBytes(n)
+	return msgpackExt{Type: int8(t), Data: p}, err
+}
+
+// Reads a big endian length of the given size, checking that it is not too
+// large.
+func (d msgpackDecoder) readLength(size int) (int, error) {
+	n, err := d.readUint(size)
+	if err != nil {
+		return 0, err
+	} else if n > msgpackMaxLength {
+		return 0, fmt.Errorf("MessagePack length too large: %d", n)
+	}
+	return int(n), nil
+}
+
+// Reads a big endian unsigned integer of the given size.
+func (d msgpackDecoder) readUint(size int) (uint64, error) {
+	p, err := d.readBytes(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range p {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d msgpackDecoder) readBytes(n int) ([]byte, error) {
+	p := make([]byte, n)
+	_, err := io.ReadFull(d.r, p)
+	return p, err
+}
@@ -0,0 +1,134 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMsgpackEncoding(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{nil, "c0"},
+		{true, "c3"},
+		{false, "c2"},
+		{0, "00"},
+		{127, "7f"},
+		{128, "cc80"},
+		{65535, "cdffff"},
+		{65536, "ce00010000"},
+		{uint64(math.MaxUint64), "cfffffffffffffffff"},
+		{-1, "ff"},
+		{-32, "e0"},
+		{-33, "d0df"},
+		{-129, "d1ff7f"},
+		{int64(math.MinInt64), "d38000000000000000"},
+		{1.5, "cb3ff8000000000000"},
+		{"abc", "a3616263"},
+		{strings.Repeat("a", 32), "d920" + strings.Repeat("61", 32)},
+		{[]byte{1, 2}, "c4020102"},
+		{[]interface{}{1, "a"}, "9201a161"},
+		{map[string]int{"a": 1}, "81a16101"},
+		{errors.New("e"), "a165"},
+		{time.Second, "a2" + hex.EncodeToString([]byte("1s"))},
+		{struct{ A int }{1}, "a5" + hex.EncodeToString([]byte("{A:1}"))},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		msgpackEncoder{&b}.writeValue(test.value)
+		if got := hex.EncodeToString(b.Bytes()); got != test.expected {
+			t.Fatalf("Expected %v to encode as %s, got %s", test.value, test.expected, got)
+		}
+	}
+}
+
+// A Stringer and error whose methods panic when called on a nil pointer.
+type msgpackPanicker struct{ name string }
+
+func (p *msgpackPanicker) String() string { return p.name }
+func (p *msgpackPanicker) Error() string  { return p.name }
+
+func TestMsgpackPanickingValues(t *testing.T) {
+	var nilPanicker *msgpackPanicker
+	for _, v := range []interface{}{fmt.Stringer(nilPanicker), error(nilPanicker)} {
+		var b bytes.Buffer
+		msgpackEncoder{&b}.writeValue(v)
+		got, err := (msgpackDecoder{bufio.NewReader(&b)}).decode()
+		if err != nil {
+			t.Fatal(err)
+		} else if s, ok := got.(string); !ok || s != "<nil>" {
+			t.Fatalf("Expected <nil>, got %#v", got)
+		}
+	}
+}
+
+func TestMsgpackEventTime(t *testing.T) {
+	var b bytes.Buffer
+	msgpackEncoder{&b}.writeEventTime(time.Unix(1, 2))
+	if got := hex.EncodeToString(b.Bytes()); got != "d7000000000100000002" {
+		t.Fatalf("Unexpected encoding %s", got)
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	values := []interface{}{
+		nil, true, false, int64(0), int64(-5), int64(200), int64(-200),
+		int64(1 << 40), int64(math.MinInt64), uint64(math.MaxUint64), 2.5,
+		"", "hello", strings.Repeat("x", 300), strings.Repeat("y", 70000),
+		[]byte{}, []byte("bin"),
+		[]interface{}{int64(1), "two", []interface{}{}},
+		map[string]interface{}{"a": int64(1), "b": map[string]interface{}{"c": "d"}},
+	}
+	var b bytes.Buffer
+	e := msgpackEncoder{&b}
+	for _, v := range values {
+		e.writeValue(v)
+	}
+	e.writeArrayHeader(20)
+	for i := 0; i < 20; i++ {
+		e.writeInt(int64(i))
+	}
+	e.writeEventTime(time.Unix(3, 4))
+
+	d := msgpackDecoder{bufio.NewReader(&b)}
+	for _, expected := range values {
+		got, err := d.decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("Expected %#v, got %#v", expected, got)
+		}
+	}
+	if got, err := d.decode(); err != nil {
+		t.Fatal(err)
+	} else if a, ok := got.([]interface{}); !ok || len(a) != 20 || a[19] != int64(19) {
+		t.Fatalf("Unexpected array %#v", got)
+	}
+	if got, err := d.decode(); err != nil {
+		t.Fatal(err)
+	} else if ext, ok := got.(msgpackExt); !ok || ext.Type != msgpackEventTimeType ||
+		!bytes.Equal(ext.Data, []byte{0, 0, 0, 3, 0, 0, 0, 4}) {
+		t.Fatalf("Unexpected extension %#v", got)
+	}
+}
+
+func TestMsgpackDecodeErrors(t *testing.T) {
+	for _, data := range []string{"c1", "a5616263", "dbffffffff", "cd00"} {
+		p, _ := hex.DecodeString(data)
+		if _, err := (msgpackDecoder{bufio.NewReader(bytes.NewReader(p))}).decode(); err == nil {
+			t.Fatalf("Expected an error decoding %s", data)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// The classes configured for each logger name, protected by nameMutex.
+	nameClasses = make(map[string]LogClass)
+	nameMutex   sync.RWMutex
+)
+
+// Named returns a new Logger with the default configuration and the given
+// name. Names are dotted paths such as "db.pool", which are used to configure
+// the classes logged by groups of Loggers with SetNameClasses, and which are
+// stored in the Name of each LineData.
+func Named(name string) *Logger {
+	logger := New()
+	logger.name = name
+	return logger
+}
+
+// Named returns a Clone of the Logger whose name is the given name appended to
+// the Logger's own name, separated with a '.'.
+func (logger *Logger) Named(name string) *Logger {
+	if logger.name != "" && name != "" {
+		return logger.clone(logger.name + "." + name)
+	}
+	return logger.clone(logger.name + name)
+}
+
+// Name returns the Logger's name, or an empty string if it has none.
+func (logger *Logger) Name() string {
+	return logger.name
+}
+
+// SetNameClasses limits the lines logged by Loggers with the given name, and by
+// Loggers whose names are below it in the hierarchy, to the given classes. The
+// most specific configured name applies, so after:
+//
+//	SetNameClasses("db", DEBUGPLUS)
+//	SetNameClasses("db.pool", WARNPLUS)
+//
+// a Logger named "db.pool.conn" logs WARN and above while one named "db.query"
+// logs DEBUG and above. The empty name applies to all Loggers which have no
+// more specific configuration. Lines must also match the classes of an output
+// in order to be written. This takes effect immediately for existing Loggers.
+func SetNameClasses(name string, classes ...LogClass) {
+	class := NONE
+	for _, c := range classes {
+		class |= c
+	}
+
+	nameMutex.Lock()
+	nameClasses[name] = class
+	nameMutex.Unlock()
+	atomic.AddUint32(&classGeneration, 1)
+}
+
+// ResetNameClasses removes the configuration for the given name, so Loggers
+// with that name inherit the classes of the name above it.
+func ResetNameClasses(name string) {
+	nameMutex.Lock()
+	delete(nameClasses, name)
+	nameMutex.Unlock()
+	atomic.AddUint32(&classGeneration, 1)
+}
+
+// NameClasses returns a copy of the classes configured for each name.
+func NameClasses() map[string]LogClass {
+	nameMutex.RLock()
+	defer nameMutex.RUnlock()
+	classes := make(map[string]LogClass, len(nameClasses))
+	for name, class := range nameClasses {
+		classes[name] = class
+	}
+	return classes
+}
+
+// ConfigureNameClasses parses a comma separated list of name=class pairs such
+// as "db=debug+, db.pool=warn+" and calls SetNameClasses for each of them. The
+// classes are parsed with ParseLogClass. Nothing is changed if any pair is
+// invalid.
+func ConfigureNameClasses(spec string) error {
+	classes, err := parseNameClasses(spec)
+	if err != nil {
+		return err
+	}
+
+	nameMutex.Lock()
+	for name, class := range classes {
+		nameClasses[name] = class
+	}
+	nameMutex.Unlock()
+	atomic.AddUint32(&classGeneration, 1)
+	return nil
+}
+
+// Parses a comma separated list of name=class pairs. As ParseLogClass also
+// accepts commas, items without an '=' are added to the class of the previous
+// pair, so "db=all,-trace" sets "db" to "all,-trace".
+func parseNameClasses(spec string) (map[string]LogClass, error) {
+	var names, specs []string
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) == 2 {
+			names = append(names, strings.TrimSpace(parts[0]))
+			specs = append(specs, parts[1])
+		} else if len(specs) > 0 {
+			specs[len(specs)-1] += "," + item
+		} else {
+			return nil, fmt.Errorf("Invalid name class setting: %s", item)
+		}
+	}
+
+	classes := make(map[string]LogClass, len(names))
+	for i, name := range names {
+		class, err := ParseLogClass(specs[i])
+		if err != nil {
+			return nil, err
+		}
+		classes[name] = class
+	}
+	return classes, nil
+}
+
+// Returns the classes configured for the most specific name at or above the
+// given name, or ALL if no name in the hierarchy is configured.
+func lookupNameClasses(name string) LogClass {
+	nameMutex.RLock()
+	defer nameMutex.RUnlock()
+	if len(nameClasses) == 0 {
+		return ALL
+	}
+	for {
+		if class, ok := nameClasses[name]; ok {
+			return class
+		}
+		if name == "" {
+			return ALL
+		}
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			name = ""
+		} else {
+			name = name[:i]
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNamedLoggers(t *testing.T) {
+	logger, o := newTestOutputLogger(t, "testnamed", ALL)
+	defer ResetNameClasses("db")
+	defer ResetNameClasses("db.pool")
+	if err := ConfigureNameClasses("db=debug+, db.pool=warn+"); err != nil {
+		t.Fatal(err)
+	}
+
+	db := logger.Named("db")
+	pool := db.Named("pool")
+	conn := pool.Named("conn")
+	if conn.Name() != "db.pool.conn" {
+		t.Fatalf("Unexpected name: %s", conn.Name())
+	}
+
+	logger.Trace("root")
+	db.Trace("db trace")
+	db.Debug("db debug")
+	conn.Info("conn info")
+	conn.Warn("conn warn")
+
+	// Changing the classes applies to existing Loggers.
+	SetNameClasses("db.pool", INFOPLUS)
+	conn.Info("conn info again")
+	logger.Flush()
+
+	expected := []struct {
+		name    string
+		message string
+	}{
+		{"", "root"},
+		{"db", "db debug"},
+		{"db.pool.conn", "conn warn"},
+		{"db.pool.conn", "conn info again"},
+	}
+	if len(o.lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d", len(expected), len(o.lines))
+	}
+	for i, e := range expected {
+		if ld := o.lines[i]; ld.Name != e.name || ld.Message != e.message {
+			t.Fatalf("Unexpected line %d: %#v", i, ld)
+		}
+	}
+}
+
+func TestNameClassesInheritRoot(t *testing.T) {
+	defer ResetNameClasses("")
+	SetNameClasses("", ERRORPLUS)
+	if lookupNameClasses("a.b") != ERRORPLUS {
+		t.Fatal("The root classes were not inherited.")
+	}
+	ResetNameClasses("")
+	if lookupNameClasses("a.b") != ALL {
+		t.Fatal("Unconfigured names should allow all classes.")
+	}
+	classes, err := parseNameClasses("a=all,-trace, a.b=info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if classes["a"] != ALL&^TRACE || classes["a.b"] != INFO {
+		t.Fatalf("Unexpected classes: %v", classes)
+	}
+	if err := ConfigureNameClasses("a=bogus"); err == nil {
+		t.Fatal("Expected an error for an invalid class.")
+	}
+	if err := ConfigureNameClasses("a"); err == nil {
+		t.Fatal("Expected an error for a missing class.")
+	}
+}
+
+func TestCategoryFormat(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	o, err := NewIOWriterOutput(buffer, "[%category%] %message%", "off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Write(&LineData{Name: "db.pool", Message: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != "[db.pool] hi\n" {
+		t.Fatalf("Unexpected output: %q", buffer.String())
+	}
+}
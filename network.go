@@ -0,0 +1,456 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The default number of lines buffered while a network output is
+	// disconnected.
+	netDefaultBuffer = 1000
+
+	// The default delay before the first reconnection attempt, which doubles
+	// with each failure up to the maximum.
+	netDefaultBackoff    = 100 * time.Millisecond
+	netDefaultMaxBackoff = 30 * time.Second
+
+	// The default timeout for connecting and for each write.
+	netDefaultTimeout = 5 * time.Second
+)
+
+// Returns a NewOutputFunc for the given network scheme: tcp, udp, unix or tls.
+//
+// The following forms are supported:
+//
+//	tcp://host:port - Connects to the host over TCP.
+//	udp://host:port - Sends each line as a UDP datagram.
+//	unix:///path - Connects to a unix stream socket.
+//	tls://host:port - Connects to the host over TCP using TLS.
+//
+// Lines are formatted as for stdout:// (see parseIOOutputOptions). If the
+// connection fails, lines are buffered while reconnecting and sent once the
+// connection has been re-established. Reconnection is retried in the
+// background after each backoff, so buffered lines are sent even if nothing
+// more is logged. Lines dropped because the buffer is full are counted by
+// DroppedLines and reported in the same way as lines dropped by the queue. The
+// query may also contain the following parameters:
+//
+//	buffer - The number of lines buffered while disconnected. Once full the
+//	    oldest lines are dropped. Defaults to 1000.
+//	backoff - The delay before reconnecting after a failure, which doubles
+//	    with each failed attempt. Defaults to 100ms.
+//	maxbackoff - The maximum delay between reconnection attempts. Defaults
+//	    to 30s.
+//	timeout - The timeout for connecting and for each write. Defaults to 5s.
+//
+// The tls scheme also accepts:
+//
+//	ca - The path to a PEM file of certificate authorities used to verify
+//	    the server, instead of the system pool.
+//	cert, key - The paths to a PEM certificate and key used to authenticate
+//	    with the server.
+//	servername - The name used to verify the server's certificate. Defaults
+//	    to the host.
+//	insecure - If true the server's certificate is not verified.
+func newOutputFuncNetwork(scheme string) NewOutputFunc {
+	return func(u *url.URL) (Output, error) {
+		if u.User != nil {
+			return nil, fmt.Errorf("Can not use a username with %s.", scheme)
+		}
+		if u.Fragment != "" {
+			return nil, fmt.Errorf("Can not use a fragment with %s.", scheme)
+		}
+		if scheme == "unix" {
+			if u.Host != "" {
+				return nil, fmt.Errorf("Can not use a hostname with unix.")
+			} else if u.Path == "" {
+				return nil, fmt.Errorf("A path is required with unix.")
+			}
+		} else {
+			if u.Path != "" && u.Path != "/" {
+				return nil, fmt.Errorf("Can not use a path with %s.", scheme)
+			} else if _, _, err := net.SplitHostPort(u.Host); err != nil {
+				return nil, fmt.Errorf("A host and port are required with %s.", scheme)
+			}
+		}
+
+		// Parse the RawQuery so we can extract the parameters.
+		values, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			return nil, err
+		}
+		options, err := parseIOOutputOptions(values)
+		if err != nil {
+			return nil, err
+		}
+		network, address := scheme, u.Host
+		if scheme == "unix" {
+			address = uriPathToFilename(u.Path)
+		} else if scheme == "tls" {
+			network = "tcp"
+		}
+		w, err := newNetWriter(network, address, values)
+		if err != nil {
+			return nil, err
+		}
+		if scheme == "tls" {
+			if w.tlsConfig, err = parseTLSConfig(u, values); err != nil {
+				return nil, err
+			}
+		}
+
+		// Check that nothing else was defined.
+		if len(values) != 0 {
+			bad := make([]string, 0, len(values))
+			for k, _ := range values {
+				bad = append(bad, k)
+			}
+			return nil, fmt.Errorf("Unknown parameters: %s", strings.Join(bad, ","))
+		}
+
+		o, err := options.newOutput(w)
+		if err != nil {
+			return nil, err
+		}
+		return &netOutput{Output: o, writer: w}, nil
+	}
+}
+
+// Creates a netWriter for the given network and address using the buffer,
+// backoff, maxbackoff and timeout parameters, which are removed from values.
+func newNetWriter(network, address string, values url.Values) (*netWriter, error) {
+	w := &netWriter{
+		network:    network,
+		address:    address,
+		buffer:     netDefaultBuffer,
+		backoff:    netDefaultBackoff,
+		maxBackoff: netDefaultMaxBackoff,
+		timeout:    netDefaultTimeout,
+	}
+	var err error
+	if v := values.Get("buffer"); v != "" {
+		if w.buffer, err = strconv.Atoi(v); err != nil || w.buffer < 0 {
+			return nil, fmt.Errorf("Invalid buffer size: %s", v)
+		}
+	}
+	for name, d := range map[string]*time.Duration{
+		"backoff":    &w.backoff,
+		"maxbackoff": &w.maxBackoff,
+		"timeout":    &w.timeout,
+	} {
+		if v := values.Get(name); v != "" {
+			if *d, err = time.ParseDuration(v); err != nil || *d <= 0 {
+				return nil, fmt.Errorf("Invalid %s: %s", name, v)
+			}
+		}
+	}
+	delete(values, "buffer")
+	delete(values, "backoff")
+	delete(values, "maxbackoff")
+	delete(values, "timeout")
+	return w, nil
+}
+
+// Builds the TLS configuration from the tls:// parameters, removing the ones
+// used from values.
+func parseTLSConfig(u *url.URL, values url.Values) (*tls.Config, error) {
+	config := &tls.Config{ServerName: u.Hostname()}
+	if v := values.Get("servername"); v != "" {
+		config.ServerName = v
+	}
+	if v := values.Get("insecure"); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid insecure setting: %s", v)
+		}
+		config.InsecureSkipVerify = insecure
+	}
+	if v := values.Get("ca"); v != "" {
+		pem, err := ioutil.ReadFile(v)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", v)
+		}
+	}
+	cert, key := values.Get("cert"), values.Get("key")
+	if (cert == "") != (key == "") {
+		return nil, fmt.Errorf("Both cert and key must be given.")
+	} else if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	for _, k := range []string{"servername", "insecure", "ca", "cert", "key"} {
+		delete(values, k)
+	}
+	return config, nil
+}
+
+// netOutput wraps the Output which formats lines for a netWriter, so that the
+// writer knows the class of each line it may have to drop.
+type netOutput struct {
+	Output
+	writer *netWriter
+}
+
+// Writes a line to the wrapped Output.
+func (o *netOutput) Write(ld *LineData) error {
+	o.writer.setClass(ld.Class)
+	return o.Output.Write(ld)
+}
+
+// Forces the connection to be re-established on the next write.
+func (o *netOutput) Reopen() error {
+	return o.writer.Reopen()
+}
+
+// Closes the connection.
+func (o *netOutput) Close() error {
+	return o.writer.Close()
+}
+
+// Returns the classes of the lines dropped since the last call.
+func (o *netOutput) takeDropped() []LogClass {
+	return o.writer.takeDropped()
+}
+
+// A write waiting to be sent by a netWriter. A write normally has a single
+// packet, but a message split into several datagrams has one for each, so that
+// it is buffered and dropped as a whole. Packets before sent have already been
+// sent.
+type netWrite struct {
+	packets [][]byte
+	sent    int
+	class   LogClass
+}
+
+// netWriter is an io.Writer which sends each write to a network connection,
+// reconnecting with exponential backoff if the connection fails. While
+// disconnected writes are buffered, up to a limit, and sent once the
+// connection has been re-established, either by the next write or Flush or by
+// a timer once the backoff has elapsed. Writes never return an error, as the
+// line is either sent, buffered, or dropped once the buffer is full.
+type netWriter struct {
+	// The network and address passed to net.Dial.
+	network string
+	address string
+
+	// If not nil the connection uses TLS.
+	tlsConfig *tls.Config
+
+	// Protects everything below, as buffered writes are retried by the timer
+	// as well as by the output's goroutine.
+	mutex sync.Mutex
+
+	// The current connection, or nil if disconnected.
+	conn net.Conn
+
+	// The maximum number of buffered writes, and the writes waiting to be sent
+	// oldest first.
+	buffer  int
+	pending []netWrite
+
+	// The class of the line being written, which is set by the Output before
+	// each write so that dropped lines can be counted by class.
+	class LogClass
+
+	// The classes of the writes dropped because the buffer was full since the
+	// last call to takeDropped.
+	dropped []LogClass
+
+	// Retries sending buffered writes once the backoff has elapsed, and is
+	// stopped once the writer has been closed.
+	timer  *time.Timer
+	closed bool
+
+	// The initial and maximum delays between reconnection attempts, the
+	// current delay, and the earliest time of the next attempt.
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	delay       time.Duration
+	nextAttempt time.Time
+
+	// The timeout for connecting and for each write.
+	timeout time.Duration
+}
+
+// Sends p, or buffers it if there is no connection.
+func (w *netWriter) Write(p []byte) (int, error) {
+	// The caller may reuse p, so buffered writes need their own copy.
+	data := make([]byte, len(p))
+	copy(data, p)
+	w.writePackets(data)
+	return len(p), nil
+}
+
+// Sends each of the packets in order, or buffers them if there is no
+// connection. The packets are buffered, dropped and counted as a single write,
+// and must not be modified afterwards.
+func (w *netWriter) writePackets(packets ...[]byte) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.queue(netWrite{packets: packets, class: w.class})
+	w.send()
+}
+
+// Attempts to send any buffered writes.
+func (w *netWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.send()
+	return nil
+}
+
+// Forces the connection to be re-established on the next write.
+func (w *netWriter) Reopen() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.disconnect()
+	w.delay = 0
+	w.nextAttempt = time.Time{}
+	return nil
+}
+
+// Attempts to send any buffered writes and then closes the connection.
+func (w *netWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.send()
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// Sets the class recorded for the following writes.
+func (w *netWriter) setClass(class LogClass) {
+	w.mutex.Lock()
+	w.class = class
+	w.mutex.Unlock()
+}
+
+// Returns the classes of the writes dropped since the last call.
+func (w *netWriter) takeDropped() []LogClass {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	dropped := w.dropped
+	w.dropped = nil
+	return dropped
+}
+
+// Adds a write to the buffer, dropping the oldest if it is full.
+func (w *netWriter) queue(write netWrite) {
+	if len(w.pending) >= w.buffer {
+		if w.buffer == 0 {
+			w.dropped = append(w.dropped, write.class)
+			return
+		}
+		w.dropped = append(w.dropped, w.pending[0].class)
+		w.pending[0] = netWrite{}
+		w.pending = w.pending[1:]
+	}
+	w.pending = append(w.pending, write)
+}
+
+// Called by the timer in order to retry sending buffered writes.
+func (w *netWriter) retry() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.closed {
+		w.send()
+	}
+}
+
+// Connects if necessary and sends buffered writes until the buffer is empty
+// or a write fails.
+func (w *netWriter) send() {
+	for len(w.pending) > 0 {
+		if w.conn == nil && !w.connect() {
+			return
+		}
+		write := &w.pending[0]
+		for write.sent < len(write.packets) {
+			w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+			if _, err := w.conn.Write(write.packets[write.sent]); err != nil {
+				w.disconnect()
+				w.scheduleReconnect()
+				return
+			}
+			write.sent++
+		}
+		w.pending[0] = netWrite{}
+		w.pending = w.pending[1:]
+	}
+	w.pending = nil
+}
+
+// Attempts to connect if the backoff has elapsed, returning true on success.
+func (w *netWriter) connect() bool {
+	if time.Now().Before(w.nextAttempt) {
+		return false
+	}
+	dialer := &net.Dialer{Timeout: w.timeout}
+	var conn net.Conn
+	var err error
+	if w.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, w.network, w.address, w.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(w.network, w.address)
+	}
+	if err != nil {
+		w.scheduleReconnect()
+		return false
+	}
+	w.conn = conn
+	w.delay = 0
+	return true
+}
+
+// Closes the current connection, if any.
+func (w *netWriter) disconnect() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// Delays the next connection attempt, doubling the delay each time. If writes
+// are buffered then the timer is set to retry sending them once the delay has
+// elapsed.
+func (w *netWriter) scheduleReconnect() {
+	if w.delay == 0 {
+		w.delay = w.backoff
+	} else if w.delay *= 2; w.delay > w.maxBackoff {
+		w.delay = w.maxBackoff
+	}
+	w.nextAttempt = time.Now().Add(w.delay)
+	if len(w.pending) == 0 || w.closed {
+		return
+	} else if w.timer == nil {
+		w.timer = time.AfterFunc(w.delay, w.retry)
+	} else {
+		w.timer.Reset(w.delay)
+	}
+}
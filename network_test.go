@@ -0,0 +1,328 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Creates an output with the given NewOutputFunc, failing the test if the URI
+// is not accepted.
+func newTestOutput(t *testing.T, f NewOutputFunc, uri string) Output {
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := f(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func writeTestLines(t *testing.T, o Output, messages ...string) {
+	for _, m := range messages {
+		if err := o.Write(&LineData{Message: m, Class: INFO}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Accepts a single connection and returns a reader for it.
+func acceptTestConn(t *testing.T, l net.Listener) (net.Conn, *bufio.Reader) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+func readTestLine(t *testing.T, r *bufio.Reader, expected string) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != expected+"\n" {
+		t.Fatalf("Expected %q, got %q", expected+"\n", line)
+	}
+}
+
+func TestNetworkTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	o := newTestOutput(t, newOutputFuncNetwork("tcp"),
+		"tcp://"+l.Addr().String()+"?format=%25message%25")
+	defer o.(io.Closer).Close()
+	writeTestLines(t, o, "one", "two")
+
+	conn, r := acceptTestConn(t, l)
+	defer conn.Close()
+	readTestLine(t, r, "one")
+	readTestLine(t, r, "two")
+}
+
+func TestNetworkTCPReconnect(t *testing.T) {
+	// Find a free port, and then close it so that connecting fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	o := newTestOutput(t, newOutputFuncNetwork("tcp"),
+		"tcp://"+addr+"?format=%25message%25&buffer=2&backoff=10ms")
+	defer o.(io.Closer).Close()
+	w := o.(*netOutput).writer
+
+	// The first attempt fails, and the lines are buffered until the backoff
+	// elapses, dropping the oldest once the buffer is full.
+	o.Write(&LineData{Message: "one", Class: DEBUG})
+	writeTestLines(t, o, "two", "three")
+	w.mutex.Lock()
+	if w.conn != nil {
+		t.Fatalf("Expected no connection.")
+	} else if len(w.pending) != 2 {
+		t.Fatalf("Expected 2 pending, got %d", len(w.pending))
+	}
+	w.mutex.Unlock()
+	if dropped := o.(lineDropper).takeDropped(); len(dropped) != 1 || dropped[0] != DEBUG {
+		t.Fatalf("Expected the debug line to be dropped, got %v", dropped)
+	}
+
+	// The buffered lines are sent by the timer without another write.
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, r := acceptTestConn(t, l)
+	defer conn.Close()
+	readTestLine(t, r, "two")
+	readTestLine(t, r, "three")
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.pending) != 0 || w.delay != 0 {
+		t.Fatalf("Expected the buffer and backoff to be reset.")
+	}
+}
+
+func TestNetworkWritePackets(t *testing.T) {
+	// Find a free port, and then close it so that connecting fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	o := newTestOutput(t, newOutputFuncNetwork("tcp"), "tcp://"+addr+"?buffer=1&backoff=10ms")
+	defer o.(io.Closer).Close()
+	w := o.(*netOutput).writer
+
+	// Packets written together are buffered and dropped as one write.
+	w.writePackets([]byte("one\n"), []byte("two\n"))
+	w.writePackets([]byte("three\n"), []byte("four\n"))
+	w.mutex.Lock()
+	if len(w.pending) != 1 || len(w.pending[0].packets) != 2 {
+		t.Fatalf("Expected 1 pending write of 2 packets, got %d", len(w.pending))
+	}
+	w.mutex.Unlock()
+	if dropped := w.takeDropped(); len(dropped) != 1 {
+		t.Fatalf("Expected 1 dropped write, got %v", dropped)
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, r := acceptTestConn(t, l)
+	defer conn.Close()
+	readTestLine(t, r, "three")
+	readTestLine(t, r, "four")
+}
+
+func TestNetworkDroppedLines(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ResetCachedOutputs()
+	defer ResetCachedOutputs()
+	uri := "tcp://" + addr + "?buffer=1&backoff=1h"
+	logger := New()
+	logger.ResetOutput()
+	if err := logger.AddOutput(uri, ALL); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("one")
+	logger.Warn("two")
+	logger.Error("three")
+	logger.Flush()
+
+	// The report of the first dropped line is written as a warning, and is
+	// itself dropped to make space for the last line.
+	dropped := DroppedLines()[uri]
+	if len(dropped) != 2 || dropped[INFO] != 1 || dropped[WARN] != 2 {
+		t.Fatalf("Expected 1 info and 2 warn lines to be dropped, got %v", dropped)
+	}
+}
+
+func TestNetworkBackoff(t *testing.T) {
+	w := &netWriter{backoff: time.Second, maxBackoff: 3 * time.Second}
+	for _, expected := range []time.Duration{
+		time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second,
+	} {
+		w.scheduleReconnect()
+		if w.delay != expected {
+			t.Fatalf("Expected %s, got %s", expected, w.delay)
+		}
+	}
+}
+
+func TestNetworkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	o := newTestOutput(t, newOutputFuncNetwork("udp"),
+		"udp://"+conn.LocalAddr().String()+"?format=json")
+	defer o.(io.Closer).Close()
+	writeTestLines(t, o, "one", "two")
+
+	for _, m := range []string{"one", "two"} {
+		if got := readPacket(t, conn); !strings.Contains(got, `"message":"`+m+`"`) ||
+			strings.Count(got, "\n") != 1 {
+			t.Fatalf("Expected a single line with %q, got %q", m, got)
+		}
+	}
+}
+
+func TestNetworkUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logray")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	o := newTestOutput(t, newOutputFuncNetwork("unix"), "unix://"+path+"?format=%25message%25")
+	defer o.(io.Closer).Close()
+	writeTestLines(t, o, "one")
+
+	conn, r := acceptTestConn(t, l)
+	defer conn.Close()
+	readTestLine(t, r, "one")
+}
+
+func TestNetworkTLS(t *testing.T) {
+	// Borrow the test certificate from httptest.
+	s := httptest.NewTLSServer(http.NotFoundHandler())
+	s.Close()
+
+	dir, err := ioutil.TempDir("", "logray")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: s.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The handshake happens on the first write, so accept concurrently.
+	type result struct {
+		line string
+		err  error
+	}
+	lines := make(chan result, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			lines <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		lines <- result{line, err}
+	}()
+
+	o := newTestOutput(t, newOutputFuncNetwork("tls"),
+		"tls://"+l.Addr().String()+"?format=%25message%25&ca="+url.QueryEscape(ca))
+	defer o.(io.Closer).Close()
+	writeTestLines(t, o, "secret")
+	if w := o.(*netOutput).writer; w.conn == nil {
+		t.Fatalf("Expected a connection.")
+	}
+
+	r := <-lines
+	if r.err != nil {
+		t.Fatal(r.err)
+	} else if r.line != "secret\n" {
+		t.Fatalf("Expected %q, got %q", "secret\n", r.line)
+	}
+}
+
+func TestNetworkBadParams(t *testing.T) {
+	for _, uri := range []string{
+		"tcp://localhost",
+		"tcp://user@localhost:1234",
+		"tcp://localhost:1234/path",
+		"tcp://localhost:1234#frag",
+		"tcp://localhost:1234?unknown=1",
+		"tcp://localhost:1234?buffer=-1",
+		"tcp://localhost:1234?backoff=soon",
+		"tcp://localhost:1234?ca=ca.pem",
+		"unix://localhost/path",
+		"unix://",
+		"tls://localhost:1234?cert=cert.pem",
+		"tls://localhost:1234?insecure=maybe",
+		"tls://localhost:1234?ca=/does/not/exist",
+	} {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newOutputFuncNetwork(u.Scheme)(u); err == nil {
+			t.Fatalf("Expected an error for %s", uri)
+		}
+	}
+}
@@ -4,6 +4,7 @@ package logray
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
@@ -28,9 +29,20 @@ type LineData struct {
 	CallingFunction string                 `json:"calling_function"`
 	SourceFile      string                 `json:"source_file"`
 	SourceLine      int                    `json:"source_line"`
+	Name            string                 `json:"name,omitempty"`
 }
 
 // Output objects are used as the actual destination for log lines.
+//
+// Each cached output has its own queue and goroutine, so calls to Write and
+// Flush on a given output are never made concurrently, and lines are written
+// to that output in the order they were logged. No ordering is guaranteed
+// between different outputs, so a slow output does not delay the lines written
+// to the others. However once a slow output's queue is full, the caller
+// logging to it waits for space under the default OverflowBlock policy, which
+// holds up everything else that caller does. Outputs which may stall, such as
+// network outputs, should use a policy which drops lines instead, set with the
+// overflow URL parameter or DefaultOverflowPolicy.
 type Output interface {
 	// Writes a line into this output device.
 	Write(data *LineData) error
@@ -53,6 +65,18 @@ type outputWrapper struct {
 
 	// The URL associated with this output.
 	URL *url.URL
+
+	// The URI the output was created with, which is its key in outputMap.
+	uri string
+
+	// Lines and other work pending for this output. This is processed by a
+	// goroutine dedicated to the output.
+	queue *outputQueue
+
+	// The number of loggerOutputWrappers that have been created for this
+	// output and not released with lockedReleaseOutput. The output is only
+	// closed by Configure once this reaches zero. Protected by updateMutex.
+	refs int
 }
 
 // Mutex used to control all actions which might cause thread safety issues.
@@ -68,7 +92,9 @@ var outputMap map[string]*outputWrapper
 
 // Adds a new output type to the map of possible outputs. This defines the
 // Scheme that will be provided via the URL. Fragments are managed by the Output
-// system rather than being dealt with in this function.
+// system rather than being dealt with in this function, as are the queue,
+// overflow and overflowtimeout parameters which configure the output's queue
+// (see OverflowPolicy).
 func AddNewOutputFunc(name string, f NewOutputFunc) bool {
 	updateMutex.Lock()
 	defer updateMutex.Unlock()
@@ -81,8 +107,19 @@ func lockedSetupOutputMap() {
 	newOutputFuncMap["stdout"] = newOutputFuncStdout
 	newOutputFuncMap["stderr"] = newOutputFuncStderr
 	newOutputFuncMap["file"] = newOutputFuncFile
+	newOutputFuncMap["rotatefile"] = newOutputFuncRotateFile
 	newOutputFuncMap["fd"] = newOutputFuncFd
 	newOutputFuncMap["discard"] = newOutputFuncDiscard
+	newOutputFuncMap["syslog"] = newOutputFuncSyslog
+	newOutputFuncMap["tcp"] = newOutputFuncNetwork("tcp")
+	newOutputFuncMap["udp"] = newOutputFuncNetwork("udp")
+	newOutputFuncMap["unix"] = newOutputFuncNetwork("unix")
+	newOutputFuncMap["tls"] = newOutputFuncNetwork("tls")
+	newOutputFuncMap["http"] = newOutputFuncHTTP
+	newOutputFuncMap["https"] = newOutputFuncHTTP
+	newOutputFuncMap["gelf"] = newOutputFuncGELF
+	newOutputFuncMap["fluent"] = newOutputFuncFluent
+	newOutputFuncMap["journald"] = newOutputFuncJournald
 	outputMap = make(map[string]*outputWrapper, 100)
 }
 
@@ -103,10 +140,13 @@ func newOutput(uri string) (o *outputWrapper, err error) {
 	return lockedNewOutput(uri)
 }
 
-// Inner locked code for NewOutput()
+// Inner locked code for NewOutput(). Each successful call adds a reference to
+// the returned output, which is expected to be used by a new
+// loggerOutputWrapper.
 func lockedNewOutput(uri string) (o *outputWrapper, err error) {
 	o, ok := outputMap[uri]
 	if ok == true {
+		o.refs++
 		return o, nil
 	}
 
@@ -122,8 +162,14 @@ func lockedNewOutput(uri string) (o *outputWrapper, err error) {
 		return nil, fmt.Errorf("Unknown url scheme: '%s'", u.Scheme)
 	}
 
+	// The queue parameters are handled here rather than by each output.
+	queue, stripped, err := newOutputQueue(u)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get the output object for this registered scheme type.
-	output, err := f(u)
+	output, err := f(stripped)
 	if err != nil {
 		return nil, err
 	} else if output == nil {
@@ -135,7 +181,10 @@ func lockedNewOutput(uri string) (o *outputWrapper, err error) {
 	wrapper := &outputWrapper{
 		Output: output,
 		URL:    u,
+		uri:    uri,
+		refs:   1,
 	}
+	wrapper.start(queue)
 	outputMap[uri] = wrapper
 
 	return wrapper, nil
@@ -167,10 +216,10 @@ func newOutputFuncStdout(u *url.URL) (Output, error) {
 	}
 
 	// Get the values we need for setting up the Output object.
-	format := values.Get("format")
-	delete(values, "format")
-	color := values.Get("color")
-	delete(values, "color")
+	options, err := parseIOOutputOptions(values)
+	if err != nil {
+		return nil, err
+	}
 
 	// Check that nothing else was defined.
 	if len(values) != 0 {
@@ -183,7 +232,7 @@ func newOutputFuncStdout(u *url.URL) (Output, error) {
 	}
 
 	// The output object we will return.
-	return NewIOWriterOutput(os.Stdout, format, color)
+	return options.newOutput(os.Stdout)
 }
 
 // Parses a URL that starts with stderr://
@@ -208,10 +257,10 @@ func newOutputFuncStderr(u *url.URL) (Output, error) {
 	}
 
 	// Get the values we need for setting up the Output object.
-	format := values.Get("format")
-	delete(values, "format")
-	color := values.Get("color")
-	delete(values, "color")
+	options, err := parseIOOutputOptions(values)
+	if err != nil {
+		return nil, err
+	}
 
 	// Check that nothing else was defined.
 	if len(values) != 0 {
@@ -224,7 +273,7 @@ func newOutputFuncStderr(u *url.URL) (Output, error) {
 	}
 
 	// The output object we will return.
-	return NewIOWriterOutput(os.Stderr, format, color)
+	return options.newOutput(os.Stderr)
 }
 
 // Parses a URL that starts with file://
@@ -249,10 +298,10 @@ func newOutputFuncFile(u *url.URL) (Output, error) {
 	}
 
 	// Get the values we need for setting up the Output object.
-	format := values.Get("format")
-	delete(values, "format")
-	color := values.Get("color")
-	delete(values, "color")
+	options, err := parseIOOutputOptions(values)
+	if err != nil {
+		return nil, err
+	}
 
 	// Check that nothing else was defined.
 	if len(values) != 0 {
@@ -263,14 +312,15 @@ func newOutputFuncFile(u *url.URL) (Output, error) {
 		return nil, fmt.Errorf("Unknown parameters: %s", strings.Join(bad, ","))
 	}
 
-	// Open the specified file
-	file, err := os.OpenFile(uriPathToFilename(u.Path), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	// Open the specified file. This is wrapped so that it can be reopened by
+	// ReopenOutputs().
+	file, err := openReopenFile(uriPathToFilename(u.Path))
 	if err != nil {
 		return nil, err
 	}
 
 	// The output object we will return.
-	return NewIOWriterOutput(file, format, color)
+	return options.newOutput(file)
 }
 
 // uriPathToFilename converts the path from a URI to a valid local file name.
@@ -306,10 +356,10 @@ func newOutputFuncFd(u *url.URL) (Output, error) {
 	}
 
 	// Get the values we need for setting up the Output object.
-	format := values.Get("format")
-	delete(values, "format")
-	color := values.Get("color")
-	delete(values, "color")
+	options, err := parseIOOutputOptions(values)
+	if err != nil {
+		return nil, err
+	}
 
 	// Check that nothing else was defined.
 	if len(values) != 0 {
@@ -330,7 +380,85 @@ func newOutputFuncFd(u *url.URL) (Output, error) {
 	file := os.NewFile(uintptr(fd), "log")
 
 	// The output object we will return.
-	return NewIOWriterOutput(file, format, color)
+	return options.newOutput(file)
+}
+
+// Options shared by all of the schemes which are backed by an io.Writer.
+type ioOutputOptions struct {
+	// The format string, or the name of a structured format like "json".
+	format string
+
+	// The color setting passed to NewIOWriterOutput.
+	color string
+
+	// The key names used by structured formats.
+	keys FieldKeys
+}
+
+// parseIOOutputOptions extracts the parameters common to all io.Writer backed
+// outputs from the given values. Any parameters used are removed from values
+// so that the caller can check for unknown parameters. The following
+// parameters are supported:
+//
+//	format - A format string (see NewIOWriterOutput), "json" or "logfmt".
+//	color - The color setting (see NewIOWriterOutput).
+//	key.<name> - Overrides the key used for the given element in structured
+//	    formats. See FieldKeys for the list of names.
+func parseIOOutputOptions(values url.Values) (*ioOutputOptions, error) {
+	options := &ioOutputOptions{
+		format: values.Get("format"),
+		color:  values.Get("color"),
+	}
+	delete(values, "format")
+	delete(values, "color")
+
+	structured := true
+	switch options.format {
+	case "json":
+		options.keys = DefaultJSONKeys
+	case "logfmt":
+		options.keys = DefaultLogfmtKeys
+	default:
+		structured = false
+	}
+
+	if !structured {
+		for k := range values {
+			if strings.HasPrefix(k, "key.") {
+				return nil, fmt.Errorf("Parameter %s requires a structured format.", k)
+			}
+		}
+	}
+	if err := parseKeyParameters(values, &options.keys); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// Applies any parameters of the form key.<name>=<key> to the given keys,
+// removing them from values.
+func parseKeyParameters(values url.Values, keys *FieldKeys) error {
+	for k, v := range values {
+		if !strings.HasPrefix(k, "key.") {
+			continue
+		}
+		if err := keys.set(k[4:], v[0]); err != nil {
+			return err
+		}
+		delete(values, k)
+	}
+	return nil
+}
+
+// newOutput creates the Output that writes to w using the parsed options.
+func (options *ioOutputOptions) newOutput(w io.Writer) (Output, error) {
+	switch options.format {
+	case "json":
+		return NewJSONOutput(w, options.keys)
+	case "logfmt":
+		return NewLogfmtOutput(w, options.keys)
+	}
+	return NewIOWriterOutput(w, options.format, options.color)
 }
 
 // Parses a URL that starts with discard://
@@ -0,0 +1,373 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of entries in baseLogClasses.
+const numBaseLogClasses = 6
+
+// OverflowPolicy defines what happens when a line is logged to an output whose
+// queue is full.
+type OverflowPolicy int
+
+const (
+	// Block the caller until there is space in the queue.
+	OverflowBlock = OverflowPolicy(iota)
+
+	// Drop the line being logged.
+	OverflowDropNewest
+
+	// Drop the oldest line in the queue to make space for the new one.
+	OverflowDropOldest
+
+	// Block the caller until there is space in the queue or the overflow
+	// timeout expires, in which case the line being logged is dropped.
+	OverflowTimeout
+)
+
+var (
+	// The number of items that can be queued for an output. This is applied to
+	// outputs as they are created, and can be overridden per output with the
+	// "queue" URL parameter.
+	DefaultQueueSize = 1000
+
+	// The policy used when an output's queue is full. This is applied to
+	// outputs as they are created, and can be overridden per output with the
+	// "overflow" URL parameter.
+	DefaultOverflowPolicy = OverflowBlock
+
+	// The maximum time a caller will block when using OverflowTimeout. This is
+	// applied to outputs as they are created, and can be overridden per output
+	// with the "overflowtimeout" URL parameter.
+	DefaultOverflowTimeout = time.Second
+
+	// How often a summary of dropped lines is written to an output that has
+	// dropped lines.
+	DropReportInterval = 10 * time.Second
+)
+
+// Returns the string representation of the policy as used in URLs.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop"
+	case OverflowDropOldest:
+		return "dropoldest"
+	case OverflowTimeout:
+		return "timeout"
+	}
+	return "unknown"
+}
+
+// Parses an overflow policy name: block, drop (or dropnewest), dropoldest or
+// timeout. This call is case insensitive.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch strings.ToLower(s) {
+	case "block":
+		return OverflowBlock, nil
+	case "drop", "dropnewest":
+		return OverflowDropNewest, nil
+	case "dropoldest":
+		return OverflowDropOldest, nil
+	case "timeout":
+		return OverflowTimeout, nil
+	}
+	return OverflowBlock, fmt.Errorf("Invalid overflow policy: %s", s)
+}
+
+// DroppedLines returns the number of lines dropped by each cached output since
+// it was created, keyed by the output's URI and then by class. This includes
+// lines dropped by the output's queue and by outputs which buffer lines
+// themselves, such as tcp://. Outputs which have not dropped any lines are not
+// included.
+func DroppedLines() map[string]map[LogClass]uint64 {
+	updateMutex.RLock()
+	defer updateMutex.RUnlock()
+
+	dropped := make(map[string]map[LogClass]uint64)
+	for uri, ow := range outputMap {
+		counts := ow.queue.droppedLines()
+		if len(counts) > 0 {
+			dropped[uri] = counts
+		}
+	}
+	return dropped
+}
+
+// Extracts the queue parameters from the URL, returning the queue and a copy of
+// the URL with those parameters removed so it can be passed to the output's
+// NewOutputFunc.
+func newOutputQueue(u *url.URL) (*outputQueue, *url.URL, error) {
+	q := &outputQueue{
+		size:    DefaultQueueSize,
+		policy:  DefaultOverflowPolicy,
+		timeout: DefaultOverflowTimeout,
+		ready:   make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		// Let the NewOutputFunc report the parsing error.
+		return q, u, nil
+	}
+	if _, ok := values["queue"]; !ok {
+		if _, ok := values["overflow"]; !ok {
+			if _, ok := values["overflowtimeout"]; !ok {
+				return q, u, nil
+			}
+		}
+	}
+
+	if v := values.Get("queue"); v != "" {
+		if q.size, err = strconv.Atoi(v); err != nil || q.size <= 0 {
+			return nil, nil, fmt.Errorf("Invalid queue size: %s", v)
+		}
+	}
+	if v := values.Get("overflow"); v != "" {
+		if q.policy, err = ParseOverflowPolicy(v); err != nil {
+			return nil, nil, err
+		}
+	}
+	if v := values.Get("overflowtimeout"); v != "" {
+		if q.timeout, err = time.ParseDuration(v); err != nil || q.timeout <= 0 {
+			return nil, nil, fmt.Errorf("Invalid overflow timeout: %s", v)
+		}
+	}
+	delete(values, "queue")
+	delete(values, "overflow")
+	delete(values, "overflowtimeout")
+
+	stripped := *u
+	stripped.RawQuery = values.Encode()
+	return q, &stripped, nil
+}
+
+// outputQueue is a bounded FIFO of work for a single output. Only lines are
+// subject to the overflow policy; other work such as flushes is always queued
+// so that callers waiting on it are not left hanging.
+type outputQueue struct {
+	// Protects everything below.
+	mutex sync.Mutex
+
+	// The pending work, oldest first.
+	items []backgroundWorker
+
+	// The configuration of the queue.
+	size    int
+	policy  OverflowPolicy
+	timeout time.Duration
+
+	// Signaled when an item is added to the queue.
+	ready chan struct{}
+
+	// Signaled when an item is removed from the queue.
+	space chan struct{}
+
+	// Set once the final item has been queued, at which point done is closed
+	// in order to release any callers blocked waiting for space.
+	closed bool
+	done   chan struct{}
+
+	// The total number of lines dropped per class, and the number dropped since
+	// the last report was written to the output.
+	dropped    [numBaseLogClasses]uint64
+	unreported [numBaseLogClasses]uint64
+
+	// The time the last report of dropped lines was written.
+	lastReport time.Time
+}
+
+// Adds an item to the queue, applying the overflow policy if it is full. This
+// returns false if the item was not queued because the queue has been closed.
+// Lines dropped by the overflow policy are not treated as a failure.
+func (q *outputQueue) push(b backgroundWorker) bool {
+	return q.pushItem(b, false)
+}
+
+// Returns true if a line pushed now would have to wait for space, because the
+// queue is full and its policy is OverflowBlock or OverflowTimeout.
+func (q *outputQueue) full() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return !q.closed && len(q.items) >= q.size &&
+		(q.policy == OverflowBlock || q.policy == OverflowTimeout)
+}
+
+// Adds a final item to the queue and closes it, so that the output's goroutine
+// exits once the item has been processed. This returns false if the queue was
+// already closed.
+func (q *outputQueue) pushFinal(b backgroundWorker) bool {
+	return q.pushItem(b, true)
+}
+
+// Inner code for push() and pushFinal()
+func (q *outputQueue) pushItem(b backgroundWorker, final bool) bool {
+	line, isLine := b.(*backgroundLineLogger)
+	var timer *time.Timer
+	expired := false
+
+	q.mutex.Lock()
+	for !q.closed && len(q.items) >= q.size && isLine {
+		switch q.policy {
+		case OverflowDropNewest:
+			q.drop(line.lineData.Class)
+			q.mutex.Unlock()
+			return true
+
+		case OverflowDropOldest:
+			for i, item := range q.items {
+				if old, ok := item.(*backgroundLineLogger); ok {
+					q.drop(old.lineData.Class)
+					copy(q.items[i:], q.items[i+1:])
+					q.items[len(q.items)-1] = nil
+					q.items = q.items[:len(q.items)-1]
+					break
+				}
+			}
+			isLine = false
+
+		case OverflowTimeout:
+			if expired {
+				q.drop(line.lineData.Class)
+				q.mutex.Unlock()
+				return true
+			} else if timer == nil {
+				timer = time.NewTimer(q.timeout)
+				defer timer.Stop()
+			}
+			q.mutex.Unlock()
+			select {
+			case <-q.space:
+			case <-q.done:
+			case <-timer.C:
+				expired = true
+			}
+			q.mutex.Lock()
+
+		default:
+			q.mutex.Unlock()
+			select {
+			case <-q.space:
+			case <-q.done:
+			}
+			q.mutex.Lock()
+		}
+	}
+	if q.closed {
+		q.mutex.Unlock()
+		return false
+	}
+	q.items = append(q.items, b)
+	if final {
+		q.closed = true
+		close(q.done)
+	}
+	q.mutex.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Removes the oldest item from the queue. If the queue is empty this returns
+// nil, along with false if the queue has been closed.
+func (q *outputQueue) pop() (backgroundWorker, bool) {
+	q.mutex.Lock()
+	if len(q.items) == 0 {
+		closed := q.closed
+		q.mutex.Unlock()
+		return nil, !closed
+	}
+	b := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.mutex.Unlock()
+
+	select {
+	case q.space <- struct{}{}:
+	default:
+	}
+	return b, true
+}
+
+// Records a dropped line. This must be called with the mutex held.
+func (q *outputQueue) drop(class LogClass) {
+	for i, c := range baseLogClasses {
+		if c == class {
+			q.dropped[i]++
+			q.unreported[i]++
+			return
+		}
+	}
+}
+
+// Records a line dropped by the output rather than by the queue.
+func (q *outputQueue) recordDrop(class LogClass) {
+	q.mutex.Lock()
+	q.drop(class)
+	q.mutex.Unlock()
+}
+
+// Returns the total number of dropped lines per class.
+func (q *outputQueue) droppedLines() map[LogClass]uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	counts := make(map[LogClass]uint64)
+	for i, n := range q.dropped {
+		if n > 0 {
+			counts[baseLogClasses[i]] = n
+		}
+	}
+	return counts
+}
+
+// Returns a line summarizing the lines dropped since the last report, or nil
+// if there is nothing to report or the last report was too recent.
+func (q *outputQueue) dropReport(now time.Time) *LineData {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if now.Sub(q.lastReport) < DropReportInterval {
+		return nil
+	}
+
+	total := uint64(0)
+	counts := make([]string, 0, len(baseLogClasses))
+	fields := make(map[string]interface{}, 1)
+	for i, n := range q.unreported {
+		if n > 0 {
+			total += n
+			counts = append(counts, fmt.Sprintf("%s=%d", baseLogClasses[i], n))
+			q.unreported[i] = 0
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	q.lastReport = now
+	sort.Strings(counts)
+	fields["dropped"] = total
+
+	return &LineData{
+		Message: fmt.Sprintf("%d lines dropped due to a full queue or buffer (%s)",
+			total, strings.Join(counts, ", ")),
+		Class:     WARN,
+		TimeStamp: now,
+		Fields:    fields,
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// gatedOutput is an Output whose Write blocks until release is closed. Once a
+// write has started entered is signaled.
+type gatedOutput struct {
+	entered chan struct{}
+	release chan struct{}
+
+	mutex sync.Mutex
+	lines []*LineData
+}
+
+func (o *gatedOutput) Write(ld *LineData) error {
+	select {
+	case o.entered <- struct{}{}:
+	default:
+	}
+	<-o.release
+	o.mutex.Lock()
+	o.lines = append(o.lines, ld)
+	o.mutex.Unlock()
+	return nil
+}
+
+func (o *gatedOutput) Flush() error { return nil }
+
+// Logs five lines to an output with a queue size of two while the output is
+// blocked writing the first, and returns the messages that were written.
+func testOverflow(t *testing.T, scheme, query string) ([]string, *LineData) {
+	o := &gatedOutput{
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	ResetCachedOutputs()
+	AddNewOutputFunc(scheme, func(u *url.URL) (Output, error) {
+		if u.RawQuery != "" {
+			t.Fatalf("Queue parameters were passed to the output: %s", u.RawQuery)
+		}
+		return o, nil
+	})
+	logger := New()
+	logger.ResetOutput()
+	uri := scheme + "://?queue=2&" + query
+	if err := logger.AddOutput(uri, ALL); err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debug("0")
+	<-o.entered
+	for i := 1; i < 5; i++ {
+		logger.Info(i)
+	}
+
+	dropped := DroppedLines()[uri]
+	if dropped[INFO] != 2 || len(dropped) != 1 {
+		t.Fatalf("Unexpected dropped counts: %v", dropped)
+	}
+
+	close(o.release)
+	logger.Flush()
+
+	var report *LineData
+	messages := make([]string, 0, len(o.lines))
+	for _, ld := range o.lines {
+		if ld.Fields["dropped"] != nil {
+			report = ld
+			continue
+		}
+		messages = append(messages, ld.Message)
+	}
+	return messages, report
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	messages, report := testOverflow(t, "testdropnewest", "overflow=drop")
+	if fmt.Sprint(messages) != "[0 1 2]" {
+		t.Fatalf("Unexpected lines written: %v", messages)
+	}
+	if report == nil || report.Class != WARN || report.Fields["dropped"] != uint64(2) {
+		t.Fatalf("Unexpected drop report: %#v", report)
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	messages, _ := testOverflow(t, "testdropoldest", "overflow=dropoldest")
+	if fmt.Sprint(messages) != "[0 3 4]" {
+		t.Fatalf("Unexpected lines written: %v", messages)
+	}
+}
+
+func TestOverflowTimeout(t *testing.T) {
+	messages, _ := testOverflow(t, "testoverflowtimeout", "overflow=timeout&overflowtimeout=10ms")
+	if fmt.Sprint(messages) != "[0 1 2]" {
+		t.Fatalf("Unexpected lines written: %v", messages)
+	}
+}
+
+func TestOverflowBadParameters(t *testing.T) {
+	for _, query := range []string{"queue=0", "overflow=bogus", "overflowtimeout=soon"} {
+		u, err := url.Parse("discard://?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := newOutputQueue(u); err == nil {
+			t.Fatalf("Expected an error for %s", query)
+		}
+	}
+}
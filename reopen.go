@@ -0,0 +1,148 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// Reopener is implemented by outputs which hold open files that can be closed
+// and opened again by path. This allows external tools such as logrotate to
+// move the file aside, after which the output will start writing to a newly
+// created file with the original name.
+type Reopener interface {
+	Reopen() error
+}
+
+var (
+	// The channel that signals registered via ReopenOnSignal are sent to.
+	reopenSignalChan chan os.Signal
+
+	// Protects reopenSignalChan.
+	reopenSignalMutex sync.Mutex
+)
+
+// ReopenOutputs causes every cached output that implements Reopener to reopen
+// its file. This is processed through each output's queue, so all lines logged
+// before this call are written to the old file and all lines after it to the
+// new one. This returns once all outputs have been reopened.
+func ReopenOutputs() error {
+	outputs := cachedOutputs()
+	b := &backgroundReopener{wg: &sync.WaitGroup{}}
+	b.wg.Add(len(outputs))
+	for _, ow := range outputs {
+		if !ow.enqueue(b) {
+			b.wg.Done()
+		}
+	}
+	b.wg.Wait()
+	return b.errs.error("Failed to reopen outputs")
+}
+
+// ReopenOnSignal calls ReopenOutputs each time the process receives one of the
+// given signals, typically syscall.SIGHUP. Errors are written to stderr as
+// there is nowhere else to report them.
+func ReopenOnSignal(sigs ...os.Signal) {
+	reopenSignalMutex.Lock()
+	defer reopenSignalMutex.Unlock()
+
+	if reopenSignalChan == nil {
+		reopenSignalChan = make(chan os.Signal, 1)
+		go func(c chan os.Signal) {
+			for range c {
+				if err := ReopenOutputs(); err != nil {
+					fmt.Fprintf(os.Stderr, "logray: %s\n", err)
+				}
+			}
+		}(reopenSignalChan)
+	}
+	signal.Notify(reopenSignalChan, sigs...)
+}
+
+// This is used to schedule a background reopen of outputs.
+type backgroundReopener struct {
+	wg   *sync.WaitGroup
+	errs outputErrors
+}
+
+// Called in order to reopen the output if it supports it.
+func (b *backgroundReopener) Process(ow *outputWrapper) {
+	defer b.wg.Done()
+	if r, ok := ow.Output.(Reopener); ok {
+		b.errs.add(ow, r.Reopen())
+	}
+}
+
+// Reopens the given io.Writer if it supports it.
+func reopenIOWriter(w io.Writer) error {
+	if r, ok := w.(Reopener); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+// reopenFile is an io.Writer that appends to a file by path and can reopen
+// that path on request.
+type reopenFile struct {
+	// Protects the file handle.
+	mutex sync.Mutex
+
+	// The path to the file.
+	path string
+
+	// The currently open file.
+	file *os.File
+}
+
+// Opens the given path for appending, creating the file if necessary.
+func openReopenFile(path string) (*reopenFile, error) {
+	r := &reopenFile{path: path}
+	if err := r.Reopen(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Writes the given bytes to the file.
+func (r *reopenFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.Write(p)
+}
+
+// Commits the current file contents to stable storage.
+func (r *reopenFile) Sync() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.Sync()
+}
+
+// Opens the path again, closing the previously open file once the new one has
+// been opened successfully.
+func (r *reopenFile) Reopen() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	old := r.file
+	r.file = file
+	r.mutex.Unlock()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// Closes the file.
+func (r *reopenFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.Close()
+}
@@ -0,0 +1,56 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReopenOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logray")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	logger := New()
+	logger.ResetOutput()
+	uri := "file://" + filepath.ToSlash(path) + "?format=" + url.QueryEscape("%message%")
+	if err := logger.AddOutput(uri, ALL); err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Info("before")
+	logger.Flush()
+
+	// Simulate logrotate moving the file aside.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("moved")
+	if err := ReopenOutputs(); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("after")
+	logger.Flush()
+
+	old, err := ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(old) != "before\nmoved\n" {
+		t.Fatalf("Unexpected contents in the rotated file: %q", old)
+	}
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "after\n" {
+		t.Fatalf("Unexpected contents in the new file: %q", current)
+	}
+}
@@ -0,0 +1,460 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The time format used to name rotated files. This sorts lexically and avoids
+// characters which are not valid in Windows file names.
+const rotateTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is an io.Writer which writes to a file, moving it aside and
+// starting a new one when it exceeds a maximum size or a time boundary passes.
+// Rotated files are optionally compressed, and old files deleted, by a
+// background goroutine.
+//
+// Each call to Write is committed entirely to one file, and since ioOutput
+// writes each line with a single call to Write, lines are never split or
+// interleaved across a rotation.
+type rotatingFile struct {
+	// Protects everything below.
+	mutex sync.Mutex
+
+	// The path of the active log file.
+	path string
+
+	// Rotate once the file would exceed this many bytes. 0 disables.
+	maxSize int64
+
+	// Rotate on boundaries of this interval. 0 disables.
+	interval time.Duration
+
+	// Remove rotated files older than this. 0 disables.
+	maxAge time.Duration
+
+	// Keep at most this many rotated files. 0 disables.
+	maxBackups int
+
+	// If true rotated files are gzip compressed.
+	compress bool
+
+	// The currently open file, and the number of bytes within it.
+	file *os.File
+	size int64
+
+	// The time at which the next interval based rotation happens.
+	nextRotate time.Time
+
+	// Used to wake the background goroutine that compresses and removes
+	// rotated files. This is created when the first rotation happens.
+	millChan chan struct{}
+
+	// Used to wait for the background goroutine to exit on Close.
+	millDone chan struct{}
+}
+
+// Parses a URL that starts with rotatefile://
+//
+// In addition to the format and color parameters supported by file:// the
+// following parameters can be given:
+//
+//	maxsize - Rotate when the file would exceed this size. Accepts a number of
+//	    bytes with an optional KB, MB or GB suffix.
+//	interval - Rotate on each boundary of this duration, eg: 1h, 24h or 1d.
+//	    Daily intervals are aligned to local midnight.
+//	maxage - Remove rotated files older than this duration, eg: 7d.
+//	maxbackups - Keep at most this many rotated files.
+//	compress - Set to gzip to compress rotated files.
+//
+// Rotated files are named by inserting the time of the rotation before the
+// extension, for example app-2014-01-02T15-04-05.000.log
+func newOutputFuncRotateFile(u *url.URL) (Output, error) {
+	if u.User != nil {
+		return nil, fmt.Errorf("Can not use a username with rotatefile.")
+	}
+	if u.Host != "" {
+		return nil, fmt.Errorf("Can not use a hostname with rotatefile.")
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("Rotatefile output must have a path specified.")
+	}
+	if u.Fragment != "" {
+		return nil, fmt.Errorf("Can not use a fragment with rotatefile.")
+	}
+
+	// Parse the RawQuery so we can extract the parameters.
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the values we need for setting up the Output object.
+	options, err := parseIOOutputOptions(values)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rotatingFile{path: uriPathToFilename(u.Path)}
+	if v := values.Get("maxsize"); v != "" {
+		if r.maxSize, err = parseByteSize(v); err != nil {
+			return nil, err
+		}
+	}
+	delete(values, "maxsize")
+	if v := values.Get("interval"); v != "" {
+		if r.interval, err = parseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+	delete(values, "interval")
+	if v := values.Get("maxage"); v != "" {
+		if r.maxAge, err = parseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+	delete(values, "maxage")
+	if v := values.Get("maxbackups"); v != "" {
+		if r.maxBackups, err = strconv.Atoi(v); err != nil || r.maxBackups < 0 {
+			return nil, fmt.Errorf("Invalid maxbackups: %s", v)
+		}
+	}
+	delete(values, "maxbackups")
+	switch v := values.Get("compress"); v {
+	case "":
+	case "gzip":
+		r.compress = true
+	default:
+		return nil, fmt.Errorf("Unknown compression: %s", v)
+	}
+	delete(values, "compress")
+
+	// Check that nothing else was defined.
+	if len(values) != 0 {
+		bad := make([]string, 0, len(values))
+		for k, _ := range values {
+			bad = append(bad, k)
+		}
+		return nil, fmt.Errorf("Unknown parameters: %s", strings.Join(bad, ","))
+	}
+
+	// Open the file now so that configuration errors are reported early.
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	// The output object we will return.
+	return options.newOutput(r)
+}
+
+// Writes the given bytes to the file, rotating it first if required.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	now := time.Now()
+	if (r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize) ||
+		(r.interval > 0 && !now.Before(r.nextRotate)) {
+		if err := r.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Commits the current file contents to stable storage.
+func (r *rotatingFile) Sync() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+// Closes and reopens the active file, which allows it to be rotated by an
+// external tool. This does not rotate the file itself.
+func (r *rotatingFile) Reopen() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file != nil {
+		if err := r.file.Close(); err != nil {
+			return err
+		}
+		r.file = nil
+	}
+	return r.open()
+}
+
+// Closes the current file and stops the background goroutine once it has
+// finished processing rotated files.
+func (r *rotatingFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var err error
+	if r.file != nil {
+		err = r.file.Close()
+		r.file = nil
+	}
+	if r.millChan != nil {
+		close(r.millChan)
+		<-r.millDone
+		r.millChan = nil
+	}
+	return err
+}
+
+// Opens (or creates) the active file. This must be called with the mutex held.
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	if r.interval > 0 {
+		r.nextRotate = nextRotateTime(time.Now(), r.interval)
+	}
+	return nil
+}
+
+// Moves the active file aside and opens a new one. This must be called with
+// the mutex held.
+func (r *rotatingFile) rotate(now time.Time) error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+
+	if err := os.Rename(r.path, r.backupName(now)); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	// Wake the background goroutine, starting it if necessary.
+	if r.compress || r.maxAge > 0 || r.maxBackups > 0 {
+		if r.millChan == nil {
+			r.millChan = make(chan struct{}, 1)
+			r.millDone = make(chan struct{})
+			go r.millLoop(r.millChan, r.millDone)
+		}
+		select {
+		case r.millChan <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Returns the name used for a file rotated at the given time. If a file with
+// that name already exists a counter is appended to keep names unique.
+func (r *rotatingFile) backupName(t time.Time) string {
+	prefix, ext := r.nameParts()
+	name := prefix + t.Format(rotateTimeFormat)
+	candidate := name + ext
+	for i := 1; ; i++ {
+		_, err := os.Stat(candidate)
+		_, errgz := os.Stat(candidate + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(errgz) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s.%d%s", name, i, ext)
+	}
+}
+
+// Returns the portions of rotated file names before and after the time stamp.
+func (r *rotatingFile) nameParts() (prefix, ext string) {
+	ext = filepath.Ext(r.path)
+	return strings.TrimSuffix(r.path, ext) + "-", ext
+}
+
+// Goroutine that compresses and removes rotated files each time it is woken.
+func (r *rotatingFile) millLoop(wake <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	for range wake {
+		r.mill()
+	}
+}
+
+// A rotated log file found on disk.
+type rotatedFile struct {
+	path string
+	time time.Time
+
+	// The counter added to the name to keep it unique, or 0.
+	seq int
+}
+
+// Compresses and removes rotated files as per the configuration. Errors are
+// ignored as there is nowhere sensible to report them.
+func (r *rotatingFile) mill() {
+	prefix, ext := r.nameParts()
+	dir := filepath.Dir(r.path)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	var files []rotatedFile
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if e.IsDir() || !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(path, prefix)
+		stamp = strings.TrimSuffix(stamp, ".gz")
+		if !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		stamp = strings.TrimSuffix(stamp, ext)
+		if len(stamp) < len(rotateTimeFormat) {
+			continue
+		}
+		t, err := time.ParseInLocation(rotateTimeFormat, stamp[:len(rotateTimeFormat)], time.Local)
+		if err != nil {
+			continue
+		}
+		seq := 0
+		if counter := stamp[len(rotateTimeFormat):]; counter != "" {
+			if seq, err = strconv.Atoi(strings.TrimPrefix(counter, ".")); err != nil {
+				continue
+			}
+		}
+		files = append(files, rotatedFile{path: path, time: t, seq: seq})
+	}
+
+	// Newest first, so anything past maxBackups can be removed.
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].time.Equal(files[j].time) {
+			return files[i].seq > files[j].seq
+		}
+		return files[i].time.After(files[j].time)
+	})
+
+	cutoff := time.Now().Add(-r.maxAge)
+	for i, f := range files {
+		if (r.maxBackups > 0 && i >= r.maxBackups) ||
+			(r.maxAge > 0 && f.time.Before(cutoff)) {
+			os.Remove(f.path)
+			continue
+		}
+		if r.compress && !strings.HasSuffix(f.path, ".gz") {
+			gzipFile(f.path)
+		}
+	}
+}
+
+// Compresses the given file to path.gz and removes the original.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	in.Close()
+	return os.Remove(path)
+}
+
+// Returns the next rotation boundary after now. Intervals that are a whole
+// number of days are aligned to local midnight, others to the interval itself.
+func nextRotateTime(now time.Time, interval time.Duration) time.Time {
+	day := 24 * time.Hour
+	if interval%day == 0 {
+		y, m, d := now.Date()
+		midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+		return midnight.AddDate(0, 0, int(interval/day))
+	}
+	return now.Truncate(interval).Add(interval)
+}
+
+// Parses a size such as 512, 10KB, 100MB or 1GB into a number of bytes.
+func parseByteSize(s string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, suffix := range []struct {
+		name string
+		size int64
+	}{
+		{"GB", 1 << 30}, {"G", 1 << 30},
+		{"MB", 1 << 20}, {"M", 1 << 20},
+		{"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(upper, suffix.name) {
+			upper = strings.TrimSuffix(upper, suffix.name)
+			multiplier = suffix.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(upper), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid size: %s", s)
+	}
+	return n * multiplier, nil
+}
+
+// Parses a duration as per time.ParseDuration, with the addition of a 'd'
+// suffix for days.
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("Invalid duration: %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid duration: %s", s)
+	}
+	return d, nil
+}
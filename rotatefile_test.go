@@ -0,0 +1,119 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotateFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logray")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	u, err := url.Parse("rotatefile://" + filepath.ToSlash(path) +
+		"?format=%25message%25&maxsize=20&maxbackups=2&compress=gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := newOutputFuncRotateFile(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each line is 10 bytes, so every other line triggers a rotation.
+	for _, msg := range []string{"line-0001", "line-0002", "line-0003",
+		"line-0004", "line-0005", "line-0006", "line-0007"} {
+		if err := o.Write(&LineData{Message: msg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "line-0007\n" {
+		t.Fatalf("Unexpected active file contents: %q", data)
+	}
+
+	// Wait for the background goroutine to compress and prune backups.
+	var backups []string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		backups, _ = filepath.Glob(filepath.Join(dir, "app-*"))
+		done := len(backups) == 2
+		for _, b := range backups {
+			if !strings.HasSuffix(b, ".log.gz") {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got: %v", backups)
+	}
+
+	// The two newest backups are kept.
+	contents := make(map[string]bool)
+	for _, b := range backups {
+		f, err := os.Open(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(gz)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[string(data)] = true
+	}
+	if !contents["line-0003\nline-0004\n"] || !contents["line-0005\nline-0006\n"] {
+		t.Fatalf("Unexpected backup contents: %v", contents)
+	}
+
+	if err := o.(*ioOutput).writer.(*rotatingFile).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateFileParameters(t *testing.T) {
+	if n, err := parseByteSize("100MB"); err != nil || n != 100<<20 {
+		t.Fatalf("Unexpected size: %d, %v", n, err)
+	}
+	if d, err := parseDuration("7d"); err != nil || d != 7*24*time.Hour {
+		t.Fatalf("Unexpected duration: %s, %v", d, err)
+	}
+
+	now := time.Date(2014, 1, 2, 15, 4, 5, 0, time.Local)
+	if next := nextRotateTime(now, 24*time.Hour); !next.Equal(time.Date(2014, 1, 3, 0, 0, 0, 0, time.Local)) {
+		t.Fatalf("Unexpected daily rotation: %s", next)
+	}
+
+	for _, query := range []string{"maxsize=big", "maxage=-1d", "compress=zip", "bogus=1"} {
+		u, err := url.Parse("rotatefile:///tmp/logray-bad.log?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newOutputFuncRotateFile(u); err == nil {
+			t.Fatalf("Expected an error for %s", query)
+		}
+	}
+}
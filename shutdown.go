@@ -0,0 +1,78 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Set to non zero once Shutdown has been called.
+var shutdownState int32
+
+// Returns true if Shutdown has been called.
+func isShutdown() bool {
+	return atomic.LoadInt32(&shutdownState) != 0
+}
+
+// Shutdown stops logging. Every cached output has its queue drained, is
+// flushed, and is then closed if it implements io.Closer, after which the
+// goroutine servicing the output exits. This returns once all outputs have been
+// closed, or with the context's error if it is done first, in which case the
+// remaining outputs continue to be drained in the background.
+//
+// Once Shutdown has been called all log lines are discarded and calls to Flush
+// return immediately. Logging can be started again by calling
+// CloseCachedOutputs and then configuring new outputs; existing Loggers will
+// continue to discard lines sent to outputs that were closed.
+func Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&shutdownState, 1)
+
+	outputs := cachedOutputs()
+	b := &backgroundCloser{wg: &sync.WaitGroup{}}
+	b.wg.Add(len(outputs))
+	for _, ow := range outputs {
+		if !ow.queue.pushFinal(b) {
+			b.wg.Done()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return b.errs.error("Failed to close outputs")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flushes and closes the output once everything already queued for it has been
+// processed, without waiting for that to happen.
+func closeOutput(ow *outputWrapper) {
+	b := &backgroundCloser{wg: &sync.WaitGroup{}}
+	b.wg.Add(1)
+	if !ow.queue.pushFinal(b) {
+		b.wg.Done()
+	}
+}
+
+// This is used to schedule the final flush and close of an output.
+type backgroundCloser struct {
+	wg   *sync.WaitGroup
+	errs outputErrors
+}
+
+// Called in order to flush and close the output.
+func (b *backgroundCloser) Process(ow *outputWrapper) {
+	defer b.wg.Done()
+	b.errs.add(ow, ow.Output.Flush())
+	if c, ok := ow.Output.(io.Closer); ok {
+		b.errs.add(ow, c.Close())
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closingOutput is an Output which records lines, flushes and closes.
+type closingOutput struct {
+	mutex   sync.Mutex
+	lines   []string
+	flushed bool
+	closed  bool
+}
+
+func (o *closingOutput) Write(ld *LineData) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.lines = append(o.lines, ld.Message)
+	return nil
+}
+
+func (o *closingOutput) Flush() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.flushed = true
+	return nil
+}
+
+func (o *closingOutput) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.closed = true
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	o := &closingOutput{}
+	ResetCachedOutputs()
+	defer CloseCachedOutputs()
+	AddNewOutputFunc("testshutdown", func(u *url.URL) (Output, error) {
+		return o, nil
+	})
+	logger := New()
+	logger.ResetOutput()
+	if err := logger.AddOutput("testshutdown://", ALL); err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Info("before")
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("after")
+	logger.Flush()
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if len(o.lines) != 1 || o.lines[0] != "before" {
+		t.Fatalf("Unexpected lines written: %v", o.lines)
+	}
+	if !o.flushed || !o.closed {
+		t.Fatalf("Output was not flushed and closed: %#v", o)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	o := &gatedOutput{
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	ResetCachedOutputs()
+	defer CloseCachedOutputs()
+	AddNewOutputFunc("testshutdowndeadline", func(u *url.URL) (Output, error) {
+		return o, nil
+	})
+	logger := New()
+	logger.ResetOutput()
+	if err := logger.AddOutput("testshutdowndeadline://", ALL); err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Info("blocked")
+	<-o.entered
+	defer close(o.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the deadline to be exceeded, got: %v", err)
+	}
+}
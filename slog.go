@@ -0,0 +1,137 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// NewSlogHandler returns a slog.Handler which writes records to the outputs
+// configured on the given Logger. Levels are mapped onto log classes as
+// follows:
+//
+//	below slog.LevelDebug          TRACE
+//	slog.LevelDebug and above      DEBUG
+//	slog.LevelInfo and above       INFO
+//	slog.LevelWarn and above       WARN
+//	slog.LevelError and above      ERROR
+//	slog.LevelError+4 and above    FATAL
+//
+// Attributes are stored in the line's Fields along with the Logger's own
+// fields, with the keys of attributes inside groups prefixed by the group names
+// separated with dots. The returned handler reads the Logger's fields when each
+// record is handled, while WithAttrs uses WithFields so the original is never
+// modified.
+func NewSlogHandler(logger *Logger) slog.Handler {
+	return &slogHandler{logger: logger}
+}
+
+// slogHandler implements slog.Handler on top of a Logger.
+type slogHandler struct {
+	// The Logger that records are written with.
+	logger *Logger
+
+	// The dotted prefix applied to attribute keys from the currently open
+	// groups, including the trailing dot.
+	prefix string
+}
+
+// Returns the log class used for the given slog level.
+func slogLevelClass(level slog.Level) LogClass {
+	switch {
+	case level < slog.LevelDebug:
+		return TRACE
+	case level < slog.LevelInfo:
+		return DEBUG
+	case level < slog.LevelWarn:
+		return INFO
+	case level < slog.LevelError:
+		return WARN
+	case level < slog.LevelError+4:
+		return ERROR
+	}
+	return FATAL
+}
+
+// Enabled reports whether any output on the Logger is configured for the log
+// class the level maps to.
+func (h *slogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.logger.Enabled(slogLevelClass(level))
+}
+
+// Handle writes the record to the Logger's outputs.
+func (h *slogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if isShutdown() {
+		return nil
+	}
+
+	ld := &LineData{
+		Message:   r.Message,
+		Class:     slogLevelClass(r.Level),
+		TimeStamp: r.Time,
+		Name:      h.logger.name,
+		Fields:    h.logger.copyFields(),
+	}
+	if ld.TimeStamp.IsZero() {
+		ld.TimeStamp = time.Now()
+	}
+	if r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		setCaller(ld, frame.Function, frame.File, frame.Line)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addSlogAttr(ld.Fields, h.prefix, a)
+		return true
+	})
+	if ld.Class == ERROR {
+		ld.Fields["stack"] = gatherStack()
+	}
+
+	h.logger.write(ld)
+	return nil
+}
+
+// WithAttrs returns a handler whose Logger is a Clone of this one with the
+// given attributes added to its fields.
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	fields := make(map[string]interface{}, len(attrs))
+	for _, a := range attrs {
+		addSlogAttr(fields, h.prefix, a)
+	}
+	return &slogHandler{logger: h.logger.WithFields(fields), prefix: h.prefix}
+}
+
+// WithGroup returns a handler which prefixes the keys of all subsequent
+// attributes with the group name.
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &slogHandler{logger: h.logger, prefix: h.prefix + name + "."}
+}
+
+// Adds the attribute to the fields, flattening groups into dotted keys. Empty
+// attributes and empty groups are ignored as required by slog.Handler, and the
+// attributes of groups with an empty key are inlined.
+func addSlogAttr(fields map[string]interface{}, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() != slog.KindGroup {
+		fields[prefix+a.Key] = a.Value.Any()
+		return
+	}
+	if a.Key != "" {
+		prefix += a.Key + "."
+	}
+	for _, ga := range a.Value.Group() {
+		addSlogAttr(fields, prefix, ga)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestSlogHandler(t *testing.T) {
+	logger, o := newTestOutputLogger(t, "testslog", INFOPLUS)
+	logger.SetField("service", "api")
+	sl := slog.New(NewSlogHandler(logger))
+
+	sl.Debug("hidden")
+	sl.With("request", 7).WithGroup("http").Info("handled",
+		"status", 200,
+		slog.Group("timing", slog.Duration("total", time.Second)))
+	sl.Log(context.Background(), slog.LevelError+4, "fatal")
+	logger.Flush()
+
+	if len(o.lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(o.lines))
+	}
+	ld := o.lines[0]
+	if ld.Message != "handled" || ld.Class != INFO {
+		t.Fatalf("Unexpected line: %#v", ld)
+	}
+	expected := map[string]interface{}{
+		"service":           "api",
+		"request":           int64(7),
+		"http.status":       int64(200),
+		"http.timing.total": time.Second,
+	}
+	if len(ld.Fields) != len(expected) {
+		t.Fatalf("Unexpected fields: %v", ld.Fields)
+	}
+	for k, v := range expected {
+		if ld.Fields[k] != v {
+			t.Fatalf("Expected field %s to be %v, got %v", k, v, ld.Fields[k])
+		}
+	}
+	if ld.SourceFile != "slog_test.go" || ld.CallingFunction != "TestSlogHandler" {
+		t.Fatalf("Unexpected caller: %s %s", ld.SourceFile, ld.CallingFunction)
+	}
+	if o.lines[1].Class != FATAL {
+		t.Fatalf("Expected a FATAL line, got %s", o.lines[1].Class)
+	}
+
+	// With must not modify the original Logger.
+	if fields := logger.Fields(); len(fields) != 1 {
+		t.Fatalf("The original Logger's fields were modified: %v", fields)
+	}
+}
+
+func TestSlogHandlerEnabled(t *testing.T) {
+	logger, _ := newTestOutputLogger(t, "testslogenabled", WARN, ERROR)
+	h := NewSlogHandler(logger)
+	ctx := context.Background()
+	for level, enabled := range map[slog.Level]bool{
+		slog.LevelDebug - 1: false,
+		slog.LevelDebug:     false,
+		slog.LevelInfo:      false,
+		slog.LevelWarn:      true,
+		slog.LevelError:     true,
+		slog.LevelError + 4: false,
+	} {
+		if h.Enabled(ctx, level) != enabled {
+			t.Fatalf("Expected Enabled(%s) to be %v", level, enabled)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writer returns an io.Writer which logs each line written to it in the given
+// class. Incomplete lines are buffered until the rest of the line is written.
+// The caller recorded for each line is the first function outside of the log,
+// fmt, io and bufio packages that called Write, so lines written via
+// fmt.Fprintf and similar are attributed to the code that made the call.
+func (logger *Logger) Writer(class LogClass) io.Writer {
+	return &logWriter{logger: logger, class: class}
+}
+
+// StdLogger returns a *log.Logger whose messages are logged in the given class.
+// The prefix, flags and output of the returned logger may be changed as usual;
+// the prefix, timestamp and file name added by the log package are stripped
+// from each message before it is logged, and messages spanning several lines
+// are kept together as a single log line.
+func (logger *Logger) StdLogger(class LogClass) *log.Logger {
+	w := &logWriter{logger: logger, class: class}
+	w.std = log.New(w, "", 0)
+	return w.std
+}
+
+// RedirectStdLog sends all output from the standard library's global log
+// package to the given Logger in the given class, as with StdLogger. The
+// returned function restores the global logger's previous output.
+func RedirectStdLog(logger *Logger, class LogClass) func() {
+	std := log.Default()
+	previous := std.Writer()
+	std.SetOutput(&logWriter{logger: logger, class: class, std: std})
+	return func() {
+		std.SetOutput(previous)
+	}
+}
+
+// logWriter is the io.Writer behind Writer, StdLogger and RedirectStdLog.
+type logWriter struct {
+	// The Logger and class lines are logged with.
+	logger *Logger
+	class  LogClass
+
+	// The *log.Logger writing to this writer, if any. When set each call to
+	// Write is a single message which has the logger's header stripped from it.
+	std *log.Logger
+
+	// Protects buf, which holds an incomplete line waiting for the rest of it
+	// to be written.
+	mutex sync.Mutex
+	buf   []byte
+}
+
+// Logs each complete line in p.
+func (w *logWriter) Write(p []byte) (int, error) {
+	if w.std != nil {
+		message := strings.TrimSuffix(string(p), "\n")
+		w.logLine(stripStdLogHeader(message, w.std.Flags(), w.std.Prefix()))
+		return len(p), nil
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.logLine(string(bytes.TrimSuffix(w.buf[:i], []byte{'\r'})))
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) == 0 {
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+// The packages whose functions are skipped when looking for the caller of
+// Write, as they only pass the line along.
+var stdLogWrapperPackages = map[string]bool{
+	"bufio":    true,
+	"fmt":      true,
+	"io":       true,
+	"log":      true,
+	"log/slog": true,
+}
+
+// Returns true if the fully qualified function name belongs to one of
+// stdLogWrapperPackages or to logWriter itself. Functions are matched by name
+// rather than by file so that this also works for binaries built with
+// -trimpath, whose standard library paths are not under GOROOT.
+func isStdLogWrapper(name string) bool {
+	if strings.HasPrefix(name, logWriterFuncPrefix) {
+		return true
+	}
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return false
+	}
+	return stdLogWrapperPackages[name[:slash+1+dot]]
+}
+
+// The prefix of the names of logWriter's methods.
+var logWriterFuncPrefix = reflect.TypeOf(logWriter{}).PkgPath() + ".(*logWriter)."
+
+// Logs a single message, attributing it to the first caller of Write outside of
+// the packages which wrap it.
+func (w *logWriter) logLine(message string) {
+	if !w.logger.Enabled(w.class) {
+		return
+	}
+
+	ld := &LineData{
+		Message:   message,
+		Class:     w.class,
+		TimeStamp: time.Now(),
+		Name:      w.logger.name,
+		Fields:    w.logger.copyFields(),
+	}
+
+	// Skip runtime.Callers, logLine and Write.
+	pc := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(3, pc)])
+	for {
+		frame, more := frames.Next()
+		if !isStdLogWrapper(frame.Function) {
+			setCaller(ld, frame.Function, frame.File, frame.Line)
+			break
+		}
+		if !more {
+			break
+		}
+	}
+	if w.class == ERROR {
+		ld.Fields["stack"] = gatherStack()
+	}
+
+	w.logger.write(ld)
+}
+
+// Removes the prefix, date, time and file name that the log package adds to
+// messages with the given flags and prefix.
+func stripStdLogHeader(s string, flags int, prefix string) string {
+	if flags&log.Lmsgprefix == 0 {
+		s = strings.TrimPrefix(s, prefix)
+	}
+	if flags&log.Ldate != 0 && len(s) >= len("2006/01/02 ") {
+		s = s[len("2006/01/02 "):]
+	}
+	if flags&(log.Ltime|log.Lmicroseconds) != 0 {
+		n := len("15:04:05 ")
+		if flags&log.Lmicroseconds != 0 {
+			n += len(".000000")
+		}
+		if len(s) >= n {
+			s = s[n:]
+		}
+	}
+	if flags&(log.Lshortfile|log.Llongfile) != 0 {
+		if i := strings.Index(s, ": "); i >= 0 {
+			s = s[i+2:]
+		}
+	}
+	if flags&log.Lmsgprefix != 0 {
+		s = strings.TrimPrefix(s, prefix)
+	}
+	return s
+}
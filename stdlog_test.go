@@ -0,0 +1,94 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"testing"
+)
+
+func TestLoggerWriter(t *testing.T) {
+	logger, o := newTestOutputLogger(t, "testwriter", ALL)
+	w := logger.Writer(WARN)
+
+	fmt.Fprint(w, "one\ntw")
+	fmt.Fprint(w, "o\r\nthree")
+	logger.Flush()
+
+	if len(o.lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(o.lines))
+	}
+	for i, expected := range []string{"one", "two"} {
+		ld := o.lines[i]
+		if ld.Message != expected || ld.Class != WARN {
+			t.Fatalf("Unexpected line %d: %#v", i, ld)
+		}
+		if ld.SourceFile != "stdlog_test.go" || ld.CallingFunction != "TestLoggerWriter" {
+			t.Fatalf("Unexpected caller: %s %s", ld.SourceFile, ld.CallingFunction)
+		}
+	}
+}
+
+func TestLoggerStdLogger(t *testing.T) {
+	logger, o := newTestOutputLogger(t, "teststdlogger", ALL)
+	std := logger.StdLogger(INFO)
+
+	std.Print("plain")
+	std.SetPrefix("[lib] ")
+	std.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+	std.Printf("with header\nand a second line")
+	std.SetFlags(log.Ldate | log.Lmsgprefix)
+	std.Println("message prefix")
+	logger.Flush()
+
+	expected := []string{"plain", "with header\nand a second line", "message prefix"}
+	if len(o.lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d", len(expected), len(o.lines))
+	}
+	for i, ld := range o.lines {
+		if ld.Message != expected[i] || ld.Class != INFO {
+			t.Fatalf("Unexpected line %d: %#v", i, ld)
+		}
+		if ld.SourceFile != "stdlog_test.go" || ld.CallingFunction != "TestLoggerStdLogger" {
+			t.Fatalf("Unexpected caller: %s %s", ld.SourceFile, ld.CallingFunction)
+		}
+	}
+}
+
+func TestRedirectStdLog(t *testing.T) {
+	logger, o := newTestOutputLogger(t, "testredirectstdlog", ALL)
+	restore := RedirectStdLog(logger, ERROR)
+	log.Printf("from the %s package", "log")
+	restore()
+	logger.Flush()
+
+	if len(o.lines) != 1 {
+		t.Fatalf("Expected 1 line, got %d", len(o.lines))
+	}
+	if ld := o.lines[0]; ld.Message != "from the log package" || ld.Class != ERROR {
+		t.Fatalf("Unexpected line: %#v", ld)
+	}
+}
+
+func TestIsStdLogWrapper(t *testing.T) {
+	tests := map[string]bool{
+		"log.(*Logger).output":                        true,
+		"log.Printf":                                  true,
+		"log/slog.(*Logger).log":                      true,
+		"fmt.Fprintf":                                 true,
+		"io.WriteString":                              true,
+		"bufio.(*Writer).Flush":                       true,
+		logWriterFuncPrefix + "Write":                 true,
+		"main.main":                                   false,
+		"github.com/example/log.Printf":               false,
+		"github.com/example/app.(*Server).handle":     false,
+		reflect.TypeOf(logWriter{}).PkgPath() + ".Fn": false,
+	}
+	for name, expected := range tests {
+		if got := isStdLogWrapper(name); got != expected {
+			t.Fatalf("Expected %v for %s, got %v", expected, name, got)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// The type of value held by a Field.
+type fieldKind uint8
+
+const (
+	anyField = fieldKind(iota)
+	stringField
+	intField
+	int64Field
+	float64Field
+	boolField
+	durationField
+	timeField
+)
+
+// Field is a single key and value which can be attached to one log line via
+// the *Fields and *w methods. Fields are created with the typed constructors
+// such as String and Int, which store the value without converting it to an
+// interface{} so that building fields for a line that is not logged is cheap.
+type Field struct {
+	// The name of the field.
+	Key string
+
+	// The value, stored according to kind.
+	kind  fieldKind
+	num   int64
+	str   string
+	iface interface{}
+}
+
+// String returns a Field with a string value.
+func String(key string, value string) Field {
+	return Field{Key: key, kind: stringField, str: value}
+}
+
+// Int returns a Field with an int value.
+func Int(key string, value int) Field {
+	return Field{Key: key, kind: intField, num: int64(value)}
+}
+
+// Int64 returns a Field with an int64 value.
+func Int64(key string, value int64) Field {
+	return Field{Key: key, kind: int64Field, num: value}
+}
+
+// Float64 returns a Field with a float64 value.
+func Float64(key string, value float64) Field {
+	return Field{Key: key, kind: float64Field, num: int64(math.Float64bits(value))}
+}
+
+// Bool returns a Field with a bool value.
+func Bool(key string, value bool) Field {
+	f := Field{Key: key, kind: boolField}
+	if value {
+		f.num = 1
+	}
+	return f
+}
+
+// Duration returns a Field with a time.Duration value.
+func Duration(key string, value time.Duration) Field {
+	return Field{Key: key, kind: durationField, num: int64(value)}
+}
+
+// Time returns a Field with a time.Time value.
+func Time(key string, value time.Time) Field {
+	// UnixNano is undefined outside of roughly the years 1678 to 2262.
+	if y := value.Year(); y < 1678 || y > 2261 {
+		return Field{Key: key, iface: value}
+	}
+	return Field{Key: key, kind: timeField, num: value.UnixNano(), iface: value.Location()}
+}
+
+// Err returns a Field named "error" holding the given error.
+func Err(err error) Field {
+	return Field{Key: "error", iface: err}
+}
+
+// Any returns a Field with an arbitrary value.
+func Any(key string, value interface{}) Field {
+	return Field{Key: key, iface: value}
+}
+
+// Value returns the value of the Field.
+func (f Field) Value() interface{} {
+	switch f.kind {
+	case stringField:
+		return f.str
+	case intField:
+		return int(f.num)
+	case int64Field:
+		return f.num
+	case float64Field:
+		return math.Float64frombits(uint64(f.num))
+	case boolField:
+		return f.num != 0
+	case durationField:
+		return time.Duration(f.num)
+	case timeField:
+		return time.Unix(0, f.num).In(f.iface.(*time.Location))
+	}
+	return f.iface
+}
+
+// Injects a log in the trace class for this category with the given fields
+// added to the line. The Logger's fields are not modified.
+func (logger *Logger) TraceFields(message string, fields ...Field) {
+	if !logger.Enabled(TRACE) {
+		return
+	}
+	logger.logFields(TRACE, message, fields, nil)
+}
+
+// Injects a log in the trace class for this category with the given keys and
+// values added to the line's fields. See Infow for how they are parsed.
+func (logger *Logger) Tracew(message string, keysAndValues ...interface{}) {
+	if !logger.Enabled(TRACE) {
+		return
+	}
+	logger.logFields(TRACE, message, nil, keysAndValues)
+}
+
+// Injects a log in the debug class for this category with the given fields
+// added to the line. The Logger's fields are not modified.
+func (logger *Logger) DebugFields(message string, fields ...Field) {
+	if !logger.Enabled(DEBUG) {
+		return
+	}
+	logger.logFields(DEBUG, message, fields, nil)
+}
+
+// Injects a log in the debug class for this category with the given keys and
+// values added to the line's fields. See Infow for how they are parsed.
+func (logger *Logger) Debugw(message string, keysAndValues ...interface{}) {
+	if !logger.Enabled(DEBUG) {
+		return
+	}
+	logger.logFields(DEBUG, message, nil, keysAndValues)
+}
+
+// Injects a log in the info class for this category with the given fields
+// added to the line. The Logger's fields are not modified.
+func (logger *Logger) InfoFields(message string, fields ...Field) {
+	if !logger.Enabled(INFO) {
+		return
+	}
+	logger.logFields(INFO, message, fields, nil)
+}
+
+// Injects a log in the info class for this category with the given keys and
+// values added to the line's fields. The Logger's fields are not modified.
+//
+// The arguments are alternating keys and values, such as
+// Infow("done", "status", 200, "path", path). A Field may be given in place of
+// a key and value pair. Keys which are not strings are converted using
+// fmt.Sprint, and a final key without a value is set to nil.
+func (logger *Logger) Infow(message string, keysAndValues ...interface{}) {
+	if !logger.Enabled(INFO) {
+		return
+	}
+	logger.logFields(INFO, message, nil, keysAndValues)
+}
+
+// Injects a log in the warn class for this category with the given fields
+// added to the line. The Logger's fields are not modified.
+func (logger *Logger) WarnFields(message string, fields ...Field) {
+	if !logger.Enabled(WARN) {
+		return
+	}
+	logger.logFields(WARN, message, fields, nil)
+}
+
+// Injects a log in the warn class for this category with the given keys and
+// values added to the line's fields. See Infow for how they are parsed.
+func (logger *Logger) Warnw(message string, keysAndValues ...interface{}) {
+	if !logger.Enabled(WARN) {
+		return
+	}
+	logger.logFields(WARN, message, nil, keysAndValues)
+}
+
+// Injects a log in the error class for this category with the given fields
+// added to the line. The Logger's fields are not modified.
+func (logger *Logger) ErrorFields(message string, fields ...Field) {
+	if !logger.Enabled(ERROR) {
+		return
+	}
+	logger.logFields(ERROR, message, fields, nil)
+}
+
+// Injects a log in the error class for this category with the given keys and
+// values added to the line's fields. See Infow for how they are parsed.
+func (logger *Logger) Errorw(message string, keysAndValues ...interface{}) {
+	if !logger.Enabled(ERROR) {
+		return
+	}
+	logger.logFields(ERROR, message, nil, keysAndValues)
+}
+
+// logFields is the same as log, but adds the given fields and keys and values
+// to the line.
+func (logger *Logger) logFields(logClass LogClass, message string, fields []Field, keysAndValues []interface{}) {
+	if isShutdown() {
+		return
+	}
+	ld := logger.newLineData(logClass, message)
+
+	for _, f := range fields {
+		ld.Fields[f.Key] = f.Value()
+	}
+	for i := 0; i < len(keysAndValues); i++ {
+		if f, ok := keysAndValues[i].(Field); ok {
+			ld.Fields[f.Key] = f.Value()
+			continue
+		}
+		key := fieldKey(keysAndValues[i])
+		var value interface{}
+		if i+1 < len(keysAndValues) {
+			i++
+			value = keysAndValues[i]
+		}
+		ld.Fields[key] = value
+	}
+
+	logger.write(ld)
+}
+
+// Returns the field name used for a key passed to the *w methods.
+func fieldKey(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
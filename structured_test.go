@@ -0,0 +1,83 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFieldValues(t *testing.T) {
+	now := time.Now()
+	err := errors.New("failed")
+	for _, test := range []struct {
+		field    Field
+		expected interface{}
+	}{
+		{String("k", "v"), "v"},
+		{Int("k", -3), -3},
+		{Int64("k", 1<<40), int64(1 << 40)},
+		{Float64("k", 1.5), 1.5},
+		{Bool("k", true), true},
+		{Duration("k", time.Minute), time.Minute},
+		{Err(err), err},
+		{Any("k", []int{1}), []int{1}},
+	} {
+		if v := test.field.Value(); !reflect.DeepEqual(v, test.expected) {
+			t.Fatalf("Expected %#v, got %#v", test.expected, v)
+		}
+	}
+	for _, tm := range []time.Time{now, time.Time{}} {
+		if v := Time("k", tm).Value().(time.Time); !v.Equal(tm) || v.Location() != tm.Location() {
+			t.Fatalf("Expected %v, got %v", tm, v)
+		}
+	}
+}
+
+func TestLoggerStructuredMethods(t *testing.T) {
+	logger, o := newTestOutputLogger(t, "teststructured", ALL)
+	logger.SetField("service", "api")
+	logger.SetField("status", 0)
+
+	logger.Infow("handled", "status", 200, Duration("took", time.Second), 7, "odd", "dangling")
+	logger.WarnFields("fields", String("service", "override"), Int("count", 2))
+	logger.Flush()
+
+	if len(o.lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(o.lines))
+	}
+	if ld := o.lines[0]; ld.Class != INFO || ld.SourceFile != "structured_test.go" {
+		t.Fatalf("Unexpected line: %#v", ld)
+	}
+	expected := map[string]interface{}{
+		"service":  "api",
+		"status":   200,
+		"took":     time.Second,
+		"7":        "odd",
+		"dangling": nil,
+	}
+	if !reflect.DeepEqual(o.lines[0].Fields, expected) {
+		t.Fatalf("Expected fields %v, got %v", expected, o.lines[0].Fields)
+	}
+	if fields := o.lines[1].Fields; fields["service"] != "override" || fields["count"] != 2 {
+		t.Fatalf("Unexpected fields: %v", fields)
+	}
+	if fields := logger.Fields(); fields["service"] != "api" || fields["status"] != 0 {
+		t.Fatalf("The Logger's fields were modified: %v", fields)
+	}
+}
+
+func BenchmarkLoggerFieldsDisabled(b *testing.B) {
+	logger := New()
+	logger.ResetOutput()
+	if err := logger.AddOutput("discard://", ERROR); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logger.InfoFields("line", String("key", "value"), Int("count", i))
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The default port used when a remote syslog host is given without one.
+const syslogDefaultPort = "514"
+
+// The structured data ID used for LineData.Fields when generating RFC 5424
+// messages. 32473 is the private enterprise number reserved for documentation
+// and examples (RFC 5612), which is the best we can do without registering one.
+const syslogDefaultSDID = "logray@32473"
+
+// The list of local sockets that will be tried, in order, when a syslog URL
+// does not include either a host or a path.
+var syslogLocalSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// Mapping of syslog facility names to their numeric code.
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// An implementation of Output which writes log lines to a syslog daemon. The
+// daemon can either be local (via a unix socket), or remote via UDP or TCP.
+type syslogOutput struct {
+	// The network and address passed to net.Dial.
+	network string
+	address string
+
+	// The candidate addresses tried when no explicit address is configured.
+	candidates []string
+
+	// If true the message is framed as per RFC 5424, otherwise RFC 3164.
+	rfc5424 bool
+
+	// The numeric facility that will be combined with the severity.
+	facility int
+
+	// The values used for the HOSTNAME, APP-NAME and PROCID header fields.
+	hostname string
+	app      string
+	pid      int
+
+	// The SD-ID used for the structured data element built from fields.
+	sdid string
+
+	// Used to render the MSG portion of each packet.
+	formatter *ioOutput
+
+	// The current connection, or nil if not connected.
+	conn net.Conn
+}
+
+// Parses a URL that starts with syslog://
+//
+// The following forms are supported:
+//
+//	syslog:// - Connects to the first local socket found.
+//	syslog:///dev/log - Connects to the given unix datagram socket.
+//	syslog://host:port - Connects to a remote host over UDP.
+//
+// The query may contain the following parameters:
+//
+//	transport - udp, tcp, unixgram or unix. Defaults to udp for remote hosts
+//	    and unixgram for local sockets.
+//	facility - The facility name (user, daemon, local0...) or number.
+//	    Defaults to user.
+//	app - The APP-NAME/TAG. Defaults to the name of the running binary.
+//	hostname - Overrides the reported host name.
+//	rfc - Either 5424 or 3164. Defaults to 3164 for local sockets and 5424
+//	    for remote hosts.
+//	sdid - The SD-ID used for fields in RFC 5424 messages.
+//	format - A format string for the MSG portion. See NewIOWriterOutput.
+//	    Defaults to "%message%".
+func newOutputFuncSyslog(u *url.URL) (Output, error) {
+	if u.User != nil {
+		return nil, fmt.Errorf("Can not use a username with syslog.")
+	}
+	if u.Fragment != "" {
+		return nil, fmt.Errorf("Can not use a fragment with syslog.")
+	}
+	if u.Host != "" && u.Path != "" {
+		return nil, fmt.Errorf("Can not use both a hostname and a path with syslog.")
+	}
+
+	// Parse the RawQuery so we can extract the parameters.
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the values we need for setting up the Output object.
+	transport := values.Get("transport")
+	delete(values, "transport")
+	facility := values.Get("facility")
+	delete(values, "facility")
+	app := values.Get("app")
+	delete(values, "app")
+	hostname := values.Get("hostname")
+	delete(values, "hostname")
+	rfc := values.Get("rfc")
+	delete(values, "rfc")
+	sdid := values.Get("sdid")
+	delete(values, "sdid")
+	format := values.Get("format")
+	delete(values, "format")
+
+	// Check that nothing else was defined.
+	if len(values) != 0 {
+		bad := make([]string, 0, len(values))
+		for k, _ := range values {
+			bad = append(bad, k)
+		}
+		return nil, fmt.Errorf("Unknown parameters: %s", strings.Join(bad, ","))
+	}
+
+	o := &syslogOutput{
+		pid:  os.Getpid(),
+		sdid: syslogDefaultSDID,
+	}
+
+	// Work out where we are sending data.
+	local := u.Host == ""
+	switch {
+	case !local:
+		o.network = "udp"
+		o.address = u.Host
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			o.address = net.JoinHostPort(u.Host, syslogDefaultPort)
+		}
+	case u.Path != "":
+		o.network = "unixgram"
+		o.address = uriPathToFilename(u.Path)
+	default:
+		o.network = "unixgram"
+		o.candidates = syslogLocalSockets
+	}
+	switch transport {
+	case "":
+	case "udp", "tcp":
+		if local {
+			return nil, fmt.Errorf("Transport %s requires a hostname.", transport)
+		}
+		o.network = transport
+	case "unixgram", "unix":
+		if !local {
+			return nil, fmt.Errorf("Transport %s can not be used with a hostname.", transport)
+		}
+		o.network = transport
+	default:
+		return nil, fmt.Errorf("Unknown syslog transport: %s", transport)
+	}
+
+	// The facility can be given as either a name or a number.
+	o.facility = syslogFacilities["user"]
+	if facility != "" {
+		if f, ok := syslogFacilities[strings.ToLower(facility)]; ok {
+			o.facility = f
+		} else if f, err := strconv.Atoi(facility); err == nil && f >= 0 && f <= 23 {
+			o.facility = f
+		} else {
+			return nil, fmt.Errorf("Unknown syslog facility: %s", facility)
+		}
+	}
+
+	switch rfc {
+	case "":
+		o.rfc5424 = !local
+	case "5424":
+		o.rfc5424 = true
+	case "3164":
+		o.rfc5424 = false
+	default:
+		return nil, fmt.Errorf("Unknown syslog rfc: %s", rfc)
+	}
+
+	if app == "" {
+		app = filepath.Base(os.Args[0])
+	}
+	o.app = syslogHeaderValue(app, 48)
+
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	o.hostname = syslogHeaderValue(hostname, 255)
+
+	if sdid != "" {
+		o.sdid = syslogSDName(sdid)
+	}
+
+	if format == "" {
+		format = "%message%"
+	}
+	o.formatter, err = newIOOutput(nil, format, "off")
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// Writes a single line to the syslog daemon. If writing fails the connection
+// will be re-established and the write retried once.
+func (o *syslogOutput) Write(ld *LineData) error {
+	msg, err := o.formatter.format(ld)
+	if err != nil {
+		return err
+	}
+	packet := o.packet(ld, msg.Bytes())
+
+	for attempt := 0; ; attempt++ {
+		if o.conn == nil {
+			if err := o.connect(); err != nil {
+				return err
+			}
+		}
+		_, err := o.conn.Write(packet)
+		if err == nil || attempt > 0 {
+			return err
+		}
+		o.conn.Close()
+		o.conn = nil
+	}
+}
+
+// Syslog connections are unbuffered so there is nothing to flush.
+func (o *syslogOutput) Flush() error {
+	return nil
+}
+
+// Closes the connection to the syslog daemon.
+func (o *syslogOutput) Close() error {
+	if o.conn == nil {
+		return nil
+	}
+	err := o.conn.Close()
+	o.conn = nil
+	return err
+}
+
+// Establishes a connection to the syslog daemon.
+func (o *syslogOutput) connect() error {
+	if o.candidates == nil {
+		conn, err := o.dial(o.address)
+		if err != nil {
+			return err
+		}
+		o.conn = conn
+		return nil
+	}
+
+	// Try each of the well known local sockets.
+	var lastErr error
+	for _, address := range o.candidates {
+		conn, err := o.dial(address)
+		if err == nil {
+			o.conn = conn
+			return nil
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// Dials the given address, falling back to a unix stream socket if a unix
+// datagram socket is refused.
+func (o *syslogOutput) dial(address string) (net.Conn, error) {
+	conn, err := net.Dial(o.network, address)
+	if err != nil && o.network == "unixgram" {
+		if conn, err2 := net.Dial("unix", address); err2 == nil {
+			o.network = "unix"
+			return conn, nil
+		}
+	}
+	return conn, err
+}
+
+// Generates the full packet, including any stream framing, for a line.
+func (o *syslogOutput) packet(ld *LineData, msg []byte) []byte {
+	pri := o.facility*8 + syslogSeverity(ld.Class)
+	buffer := bytes.NewBuffer(make([]byte, 0, len(msg)+128))
+
+	if o.rfc5424 {
+		// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+		fmt.Fprintf(buffer, "<%d>1 %s %s %s %d - ",
+			pri, ld.TimeStamp.Format("2006-01-02T15:04:05.000000Z07:00"),
+			o.hostname, o.app, o.pid)
+		o.writeStructuredData(buffer, ld.Fields)
+		if len(msg) > 0 {
+			buffer.WriteByte(' ')
+			buffer.Write(msg)
+		}
+	} else {
+		// <PRI>TIMESTAMP HOSTNAME TAG[PID]: MSG
+		//
+		// Local daemons expect the hostname to be omitted, as is done by libc.
+		fmt.Fprintf(buffer, "<%d>%s ", pri, ld.TimeStamp.Format("Jan _2 15:04:05"))
+		if o.network != "unixgram" && o.network != "unix" {
+			buffer.WriteString(o.hostname)
+			buffer.WriteByte(' ')
+		}
+		fmt.Fprintf(buffer, "%s[%d]: ", o.app, o.pid)
+		buffer.Write(msg)
+	}
+
+	// Stream transports need framing so the daemon can tell where messages
+	// end. RFC 5424 uses octet counting (RFC 6587) while the older format is
+	// newline delimited.
+	if o.network == "tcp" || o.network == "unix" {
+		if o.rfc5424 {
+			return append([]byte(strconv.Itoa(buffer.Len())+" "), buffer.Bytes()...)
+		}
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes()
+}
+
+// Writes the STRUCTURED-DATA portion of a RFC 5424 message. Fields are written
+// as the parameters of a single element, sorted by name.
+func (o *syslogOutput) writeStructuredData(b *bytes.Buffer, fields map[string]interface{}) {
+	if len(fields) == 0 {
+		b.WriteByte('-')
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b.WriteByte('[')
+	b.WriteString(o.sdid)
+	for _, k := range keys {
+		b.WriteByte(' ')
+		b.WriteString(syslogSDName(k))
+		b.WriteString(`="`)
+		for _, r := range fmt.Sprint(fields[k]) {
+			if r == '"' || r == '\\' || r == ']' {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte(']')
+}
+
+// Returns the syslog severity for a given log class.
+func syslogSeverity(class LogClass) int {
+	switch class {
+	case FATAL:
+		return 2 // crit
+	case ERROR:
+		return 3 // err
+	case WARN:
+		return 4 // warning
+	case INFO:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// Sanitizes a header field value, which must be printable US-ASCII without
+// spaces. Empty values are replaced with the NILVALUE.
+func syslogHeaderValue(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > max {
+		s = s[:max]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Sanitizes a SD-NAME, which additionally may not contain '=', ']' or '"' and
+// is limited to 32 characters.
+func syslogSDName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > 32 {
+		s = s[:32]
+	}
+	if s == "" {
+		return "_"
+	}
+	return s
+}
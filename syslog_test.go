@@ -0,0 +1,130 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func readPacket(t *testing.T, conn net.PacketConn) string {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSyslogRFC5424UDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	o := newTestOutput(t, newOutputFuncSyslog, "syslog://"+conn.LocalAddr().String()+
+		"?facility=local0&app=myapp&hostname=box")
+	ld := &LineData{
+		Message:   "hello",
+		Class:     WARN,
+		TimeStamp: time.Date(2014, 1, 2, 3, 4, 5, 6000, time.UTC),
+		Fields:    map[string]interface{}{"b": `quo"te]`, "a": 1},
+	}
+	if err := o.Write(ld); err != nil {
+		t.Fatal(err)
+	}
+
+	// local0 (16) * 8 + warning (4) = 132
+	expected := "<132>1 2014-01-02T03:04:05.000006Z box myapp " +
+		strconv.Itoa(os.Getpid()) + ` - [logray@32473 a="1" b="quo\"te\]"] hello`
+	if got := readPacket(t, conn); got != expected {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestSyslogRFC3164Unixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logray")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	o := newTestOutput(t, newOutputFuncSyslog, "syslog://"+path+"?app=myapp")
+	ld := &LineData{
+		Message:   "hello",
+		Class:     ERROR,
+		TimeStamp: time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := o.Write(ld); err != nil {
+		t.Fatal(err)
+	}
+
+	// user (1) * 8 + err (3) = 11
+	expected := "<11>Jan  2 03:04:05 myapp[" + strconv.Itoa(os.Getpid()) + "]: hello"
+	if got := readPacket(t, conn); got != expected {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestSyslogTCPFraming(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	o := newTestOutput(t, newOutputFuncSyslog, "syslog://"+l.Addr().String()+
+		"?transport=tcp&hostname=box&app=a")
+	ld := &LineData{Message: "x", Class: INFO, TimeStamp: time.Unix(0, 0).UTC()}
+	go o.Write(ld)
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := "<14>1 1970-01-01T00:00:00.000000Z box a " + strconv.Itoa(os.Getpid()) + " - - x"
+	expected := strconv.Itoa(len(msg)) + " " + msg
+	if got := string(buf[:n]); got != expected {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestSyslogBadParameters(t *testing.T) {
+	for _, uri := range []string{
+		"syslog://host?facility=bogus",
+		"syslog://host?rfc=1234",
+		"syslog:///dev/log?transport=tcp",
+		"syslog://host?unknown=1",
+	} {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newOutputFuncSyslog(u); err == nil {
+			t.Fatalf("Expected an error for %s", uri)
+		}
+	}
+}
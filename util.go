@@ -15,21 +15,28 @@ func packageFilenameLine(ld *LineData, depth int) {
 	if !ok {
 		return
 	}
+	name := ""
+	if f := runtime.FuncForPC(i); f != nil {
+		name = f.Name()
+	}
+	setCaller(ld, name, filename, linenum)
+}
 
+// setCaller updates the LineData with the package, function, source file and
+// line number from the given fully qualified function name and file path.
+func setCaller(ld *LineData, name, filename string, linenum int) {
 	// Strip the directory from the filename. Even on Windows this is slash
 	// delimited. See https://github.com/golang/go/issues/3335.
 	fileParts := strings.Split(filename, "/")
 	ld.SourceFile = fileParts[len(fileParts)-1]
 	ld.SourceLine = linenum
 
-	// Set up params from the call stack.
-	f := runtime.FuncForPC(i)
-	if f == nil {
+	if name == "" {
 		return
 	}
 
 	// generate the separate package name and function name
-	packagePath := strings.Split(f.Name(), "/")
+	packagePath := strings.Split(name, "/")
 	n := len(packagePath)
 	pkgFunc := strings.SplitN(packagePath[n-1], ".", 2)
 	if len(pkgFunc) != 2 {
@@ -0,0 +1,97 @@
+// Copyright 2012-2014 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// How often files passed to WatchConfig are checked for changes.
+var WatchConfigInterval = 2 * time.Second
+
+// WatchConfig applies the JSON configuration in the given file with
+// ConfigureFromJSON, and then applies it again each time the contents of the
+// file change. The file is checked every WatchConfigInterval. After each
+// attempt to apply the file the callback, if not nil, is called with the
+// result, which is nil on success. Errors reading the file are reported once
+// until the file can be read again. The returned function stops watching the
+// file.
+//
+// See Configure for how changes to the default outputs are applied.
+func WatchConfig(path string, callback func(error)) (stop func()) {
+	w := &configWatcher{
+		path:     path,
+		callback: callback,
+		stop:     make(chan struct{}),
+	}
+	w.check()
+	go w.run()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() { close(w.stop) })
+	}
+}
+
+// configWatcher polls a single configuration file.
+type configWatcher struct {
+	// The file being watched.
+	path string
+
+	// Called with the result of each attempt to apply the file.
+	callback func(error)
+
+	// Closed in order to stop watching.
+	stop chan struct{}
+
+	// The hash of the contents last applied, or the last error reading the
+	// file, which are used to detect changes.
+	hash    []byte
+	readErr string
+}
+
+// Checks the file until stopped.
+func (w *configWatcher) run() {
+	ticker := time.NewTicker(WatchConfigInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// Applies the file if it has changed since it was last checked.
+func (w *configWatcher) check() {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		if err.Error() != w.readErr {
+			w.readErr = err.Error()
+			w.hash = nil
+			w.report(err)
+		}
+		return
+	}
+	w.readErr = ""
+
+	sum := sha256.Sum256(data)
+	if bytes.Equal(sum[:], w.hash) {
+		return
+	}
+	w.hash = sum[:]
+	w.report(ConfigureFromJSON(bytes.NewReader(data)))
+}
+
+// Calls the callback if there is one.
+func (w *configWatcher) report(err error) {
+	if w.callback != nil {
+		w.callback(err)
+	}
+}
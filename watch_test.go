@@ -0,0 +1,94 @@
+// Copyright 2012-2016 Apcera Inc. All rights reserved.
+
+package logray
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logray")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "logray.json")
+
+	outputs := make(map[string]*closingOutput)
+	ResetCachedOutputs()
+	ResetDefaultOutput()
+	defer ResetDefaultOutput()
+	AddNewOutputFunc("testwatch", func(u *url.URL) (Output, error) {
+		o := &closingOutput{}
+		outputs[u.Host] = o
+		return o, nil
+	})
+	defer func(interval time.Duration) {
+		WatchConfigInterval = interval
+	}(WatchConfigInterval)
+	WatchConfigInterval = 5 * time.Millisecond
+
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results := make(chan error, 10)
+	next := func() error {
+		select {
+		case err := <-results:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the configuration to be applied.")
+		}
+		return nil
+	}
+
+	write(`{"outputs": [{"uri": "testwatch://a", "class": "info+"}, {"uri": "testwatch://b", "class": "all"}]}`)
+	stop := WatchConfig(path, func(err error) { results <- err })
+	defer stop()
+	if err := next(); err != nil {
+		t.Fatal(err)
+	}
+	logger := New()
+	if !logger.Enabled(DEBUG) {
+		t.Fatal("The configured classes were not applied.")
+	}
+
+	// Invalid configurations are reported and not applied.
+	write(`{"outputs": [`)
+	if err := next(); err == nil {
+		t.Fatal("Expected an error for an invalid configuration.")
+	}
+
+	// Removed outputs are closed, and the classes of remaining outputs are
+	// updated for existing Loggers.
+	write(`{"outputs": [{"uri": "testwatch://a", "class": "warn+"}]}`)
+	if err := next(); err != nil {
+		t.Fatal(err)
+	}
+	if logger.Enabled(INFO) || !logger.Enabled(WARN) {
+		t.Fatal("The classes of an existing Logger were not updated.")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b := outputs["b"]
+		b.mutex.Lock()
+		closed := b.closed
+		b.mutex.Unlock()
+		if closed {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("The removed output was not closed.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if a := outputs["a"]; a.closed {
+		t.Fatal("The remaining output was closed.")
+	}
+}
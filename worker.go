@@ -2,61 +2,169 @@
 
 package logray
 
-// Interface which defines background workers which can be run.
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interface which defines background workers which can be run against an
+// output by the output's goroutine.
 type backgroundWorker interface {
-	Process()
+	Process(ow *outputWrapper)
 }
 
-// This is the common channel that all log lines will be passed through.
-var transitChannel chan backgroundWorker
+// Implemented by outputs which drop lines themselves, such as the network
+// outputs when their buffer fills while disconnected, so that those lines are
+// counted along with the lines dropped by the output's queue.
+type lineDropper interface {
+	// Returns the classes of the lines dropped since the last call.
+	takeDropped() []LogClass
+}
 
 // This is used to schedule a background flush.
 type backgroundFlusher struct {
-	logger     *Logger
-	updateChan chan struct{}
+	wg *sync.WaitGroup
 }
 
-// Called in order to flush all output's associated with the logger.
-func (b *backgroundFlusher) Process() {
-	b.logger.outputMutex.RLock()
-	defer b.logger.outputMutex.RUnlock()
-
-	for _, o := range b.logger.outputs {
-		o.OutputWrapper.Output.Flush()
-	}
-	if b.updateChan != nil {
-		close(b.updateChan)
-	}
+// Called in order to flush the output.
+func (b *backgroundFlusher) Process(ow *outputWrapper) {
+	ow.Output.Flush()
+	b.wg.Done()
 }
 
 // This is used to schedule a background log line write.
 type backgroundLineLogger struct {
-	lineData LineData
-	logger   *Logger
+	lineData *LineData
 }
 
-// Calls the appropriate functions to commit logging data into the proper
-// outputs.
-func (b *backgroundLineLogger) Process() {
-	b.logger.outputMutex.RLock()
-	defer b.logger.outputMutex.RUnlock()
+// Commits the logging data into the output.
+func (b *backgroundLineLogger) Process(ow *outputWrapper) {
+	ow.Output.Write(b.lineData)
+}
 
-	for _, o := range b.logger.outputs {
-		if o.Class&b.lineData.Class == b.lineData.Class {
-			o.OutputWrapper.Output.Write(&b.lineData)
-		}
-	}
+// Starts the goroutine that processes the output's queue.
+func (ow *outputWrapper) start(q *outputQueue) {
+	ow.queue = q
+	go ow.run()
+}
+
+// Adds an item to the output's queue, applying the queue's overflow policy if
+// it is full. This returns false if the output has been closed.
+func (ow *outputWrapper) enqueue(b backgroundWorker) bool {
+	return ow.queue.push(b)
 }
 
-// Goroutine used to actually perform the logging.
-func goLogger() {
+// Goroutine used to actually perform the logging for a single output.
+func (ow *outputWrapper) run() {
+	ticker := time.NewTicker(DropReportInterval)
+	defer ticker.Stop()
+
 	// Note that we currently do not handle or do anything with a panic that is
 	// thrown at any point during the log writing process. It is assumed that all
 	// writers will manage that internally.  This decision is intentional as
 	// recovering from panics might in turn mean that we silently drop logs on the
 	// floor.
 	for {
-		t := <-transitChannel
-		t.Process()
+		b, open := ow.queue.pop()
+		if !open {
+			return
+		} else if b == nil {
+			select {
+			case <-ow.queue.ready:
+			case now := <-ticker.C:
+				ow.collectDrops()
+				ow.reportDrops(now)
+			}
+			continue
+		}
+		b.Process(ow)
+		ow.collectDrops()
+		ow.reportDrops(time.Now())
+	}
+}
+
+// Adds the lines dropped by the output itself, if any, to the queue's counts.
+func (ow *outputWrapper) collectDrops() {
+	if d, ok := ow.Output.(lineDropper); ok {
+		for _, class := range d.takeDropped() {
+			ow.queue.recordDrop(class)
+		}
+	}
+}
+
+// Writes a summary of dropped lines to the output if one is due.
+func (ow *outputWrapper) reportDrops(now time.Time) {
+	if ld := ow.queue.dropReport(now); ld != nil {
+		ow.Output.Write(ld)
+	}
+}
+
+// Queues a flush on each of the given outputs and waits for all of them to
+// complete.
+func flushOutputs(outputs []*outputWrapper) {
+	wg := &sync.WaitGroup{}
+	wg.Add(len(outputs))
+	b := &backgroundFlusher{wg: wg}
+	for _, ow := range outputs {
+		if !ow.enqueue(b) {
+			wg.Done()
+		}
+	}
+	wg.Wait()
+}
+
+// Returns the unique outputs referenced by the given loggerOutputWrappers.
+func uniqueOutputs(outputs []*loggerOutputWrapper) []*outputWrapper {
+	seen := make(map[*outputWrapper]bool, len(outputs))
+	unique := make([]*outputWrapper, 0, len(outputs))
+	for _, o := range outputs {
+		if !seen[o.OutputWrapper] {
+			seen[o.OutputWrapper] = true
+			unique = append(unique, o.OutputWrapper)
+		}
+	}
+	return unique
+}
+
+// Returns all of the currently cached outputs.
+func cachedOutputs() []*outputWrapper {
+	updateMutex.RLock()
+	defer updateMutex.RUnlock()
+	outputs := make([]*outputWrapper, 0, len(outputMap))
+	for _, ow := range outputMap {
+		outputs = append(outputs, ow)
+	}
+	return outputs
+}
+
+// outputErrors collects the errors returned by outputs while processing work
+// queued on several outputs at once.
+type outputErrors struct {
+	mutex sync.Mutex
+	errs  []string
+}
+
+// Records the error returned by the given output, if any.
+func (e *outputErrors) add(ow *outputWrapper, err error) {
+	if err == nil {
+		return
+	}
+	e.mutex.Lock()
+	e.errs = append(e.errs, fmt.Sprintf("%s: %s", ow.URL, err))
+	e.mutex.Unlock()
+}
+
+// Returns a single error describing all recorded errors, or nil if there were
+// none.
+func (e *outputErrors) error(prefix string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if len(e.errs) == 0 {
+		return nil
 	}
+	sort.Strings(e.errs)
+	return fmt.Errorf("%s: %s", prefix, strings.Join(e.errs, ", "))
 }